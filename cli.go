@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// where commands write their results
+var output io.Writer = os.Stdout
+
+type command struct {
+	usage       string
+	description string
+	run         func(ctx context.Context, args []string) error
+}
+
+var commands = map[string]command{
+	"collect": {
+		usage:       "collect [flags]",
+		description: "collect from every vCenter adapter and send the results to HostDB (default)",
+		run:         collect,
+	},
+	"daemon": {
+		usage:       "daemon [flags]",
+		description: "keep running, collecting on the schedules in config",
+		run:         daemon,
+	},
+	"list-adapters": {
+		usage:       "list-adapters [flags]",
+		description: "list the adapter instances known to vROps",
+		run:         listAdapters,
+	},
+	"replay": {
+		usage:       "replay [flags]",
+		description: "re-send recordsets spooled after failing to reach HostDB",
+		run:         replay,
+	},
+	"show-config": {
+		usage:       "show-config [flags]",
+		description: "print the effective configuration, with secrets redacted",
+		run:         showConfig,
+	},
+	"show-resource": {
+		usage:       "show-resource [flags] <id>",
+		description: "show the properties of a single vROps resource",
+		run:         showResource,
+	},
+	"validate-config": {
+		usage:       "validate-config [flags]",
+		description: "load the configuration and report any problems",
+		run:         validateConfig,
+	},
+}
+
+// command line flags, and the config keys they override
+var flagBindings = map[string]string{
+	"debug":          "collector.debug",
+	"diff":           "collector.diff",
+	"exclude":        "collector.exclude",
+	"include":        "collector.include",
+	"log-format":     "collector.log_format",
+	"log-level":      "collector.log_level",
+	"sample-data":    "collector.sample_data",
+	"snapshot-dir":   "collector.snapshot_dir",
+	"stream":         "collector.stream",
+	"schedule":       "daemon.schedule",
+	"chunk-bytes":    "hostdb.chunk_bytes",
+	"chunk-records":  "hostdb.chunk_records",
+	"spool-dir":      "hostdb.spool_dir",
+	"metrics-listen": "metrics.listen",
+	"pushgateway":    "metrics.pushgateway",
+	"host":           "vrops.host",
+	"page-size":      "vrops.pageSize",
+	"resource-kinds": "vrops.resourceKindKeys",
+	"user":           "vrops.user",
+}
+
+// split the arguments into a command name, and whatever follows it
+func parseCommand(args []string) (name string, rest []string) {
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return args[0], args[1:]
+	}
+
+	return "collect", args
+
+}
+
+func newFlagSet(name string) *pflag.FlagSet {
+
+	flags := pflag.NewFlagSet(name, pflag.ContinueOnError)
+
+	flags.StringSlice("config", nil, "config file to load instead of config.yaml; repeat to layer more files over it")
+	flags.String("env", "", "an environment, e.g. prod, whose config.<env>.yaml is layered over the config file")
+	flags.Bool("debug", false, "output additional detail")
+	flags.Bool("diff", false, "compare each vCenter against the previous run's snapshot")
+	flags.StringSlice("include", nil, "only collect these adapter instance IDs, names or vCenter URLs (globs allowed)")
+	flags.StringSlice("exclude", nil, "skip these adapter instance IDs, names or vCenter URLs (globs allowed)")
+	flags.String("log-format", "", "text or json")
+	flags.String("log-level", "", "debug, info, warn or error")
+	flags.Bool("sample-data", false, "save collected data to /sample-data instead of sending it to HostDB")
+	flags.String("snapshot-dir", "", "where to keep snapshots for comparison between runs")
+	flags.String("stream", "", "write records one per line as they're collected, to a file or - for stdout, instead of the sinks")
+	flags.String("schedule", "", "when running as a daemon, a cron expression or an interval such as @every 4h")
+	flags.Int("chunk-bytes", 0, "split recordsets larger than this many bytes into chunks when sending to HostDB")
+	flags.Int("chunk-records", 0, "split recordsets with more than this many records into chunks when sending to HostDB")
+	flags.String("spool-dir", "", "where to keep recordsets which couldn't be sent to HostDB, for replay")
+	flags.String("metrics-listen", "", "when running as a daemon, serve prometheus metrics on this address, e.g. :9090")
+	flags.String("pushgateway", "", "when running once, push prometheus metrics to this pushgateway URL")
+	flags.String("host", "", "vROps URL, e.g. https://vrops.pdxfixit.com")
+	flags.Int("page-size", 0, "number of resources to request per page")
+	flags.StringSlice("resource-kinds", nil, "resource kind keys to collect")
+	flags.String("user", "", "vROps username")
+
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: hostdb-collector-vrops %s\n\n%s\n\nFlags:\n", commands[name].usage, commands[name].description)
+		flags.PrintDefaults()
+	}
+
+	return flags
+
+}
+
+// any flags given on the command line will take precedence over the config file and environment
+func bindFlags(flags *pflag.FlagSet) (err error) {
+
+	for name, key := range flagBindings {
+		if err := viper.BindPFlag(key, flags.Lookup(name)); err != nil {
+			return err
+		}
+	}
+
+	// which files to load can't come from the files themselves
+	if flags.Changed("config") {
+		if configFiles, err = flags.GetStringSlice("config"); err != nil {
+			return err
+		}
+	}
+	if flags.Changed("env") {
+		if configEnv, err = flags.GetString("env"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+func usage() {
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: hostdb-collector-vrops <command> [flags]\n\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, commands[name].description)
+	}
+
+}
+
+// get a session token, and use it for all subsequent vrops requests
+func login(ctx context.Context) error {
+
+	token, err := getSessionToken(ctx)
+	if err != nil && ctx.Err() != nil {
+		// being interrupted isn't a problem with the credentials
+		return withExitCode(exitCollection, err)
+	} else if err != nil {
+		return withExitCode(exitAuth, fmt.Errorf("unable to log in to %s: %v", config.Vrops.Host, err))
+	}
+
+	vropsSessionHeaders["Authorization"] = fmt.Sprintf(
+		"vRealizeOpsToken %s",
+		token,
+	)
+
+	return nil
+
+}
+
+// list-adapters
+func listAdapters(ctx context.Context, args []string) (err error) {
+
+	if len(args) > 0 {
+		return withExitCode(exitUsage, fmt.Errorf("unexpected arguments: %v", args))
+	}
+
+	if err := login(ctx); err != nil {
+		return err
+	}
+
+	adapters := vropsAdapterList{}
+	if err := adapters.LoadFrom(ctx, fmt.Sprintf(
+		"%s/suite-api/api/adapters?compression=enabled",
+		config.Vrops.Host,
+	)); err != nil {
+		return err
+	}
+
+	rows := [][]string{{"ID", "KIND", "NAME", "VCURL", "DESCRIPTION"}}
+	for _, adapter := range adapters.Instances {
+		rows = append(rows, []string{
+			adapter.ID,
+			adapter.ResourceKey.AdapterKindKey,
+			adapter.ResourceKey.Name,
+			adapter.VcURL(),
+			adapter.Description,
+		})
+	}
+
+	return printTable(rows)
+
+}
+
+// show-resource <id>
+func showResource(ctx context.Context, args []string) (err error) {
+
+	if len(args) != 1 {
+		return withExitCode(exitUsage, errors.New("show-resource requires exactly one resource id"))
+	}
+
+	if err := login(ctx); err != nil {
+		return err
+	}
+
+	properties := vropsResourceProperties{}
+	if err := properties.LoadFrom(ctx, fmt.Sprintf(
+		"%s/suite-api/api/resources/%s/properties?compression=enabled",
+		config.Vrops.Host,
+		args[0],
+	)); err != nil {
+		return err
+	}
+
+	rows := [][]string{{"resourceId", properties.ResourceID}}
+	for _, property := range properties.Property {
+		rows = append(rows, []string{property.Name, property.Value})
+	}
+
+	return printTable(rows)
+
+}
+
+// validate-config
+func validateConfig(ctx context.Context, args []string) (err error) {
+
+	if len(args) > 0 {
+		return withExitCode(exitUsage, fmt.Errorf("unexpected arguments: %v", args))
+	}
+
+	if errs := configProblems(); len(errs) > 0 {
+		for _, problem := range errs {
+			if _, err := fmt.Fprintln(output, problem); err != nil {
+				return err
+			}
+		}
+		return withExitCode(exitConfig, fmt.Errorf("found %d problems with the configuration", len(errs)))
+	}
+
+	_, err = fmt.Fprintln(output, "Configuration OK.")
+
+	return err
+
+}
+
+// show-config
+func showConfig(ctx context.Context, args []string) (err error) {
+
+	if len(args) > 0 {
+		return withExitCode(exitUsage, fmt.Errorf("unexpected arguments: %v", args))
+	}
+
+	data, err := yaml.Marshal(effectiveConfig())
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(output, "# %s\n%s", strings.Join(configFilesUsed, ", "), data)
+
+	return err
+
+}
+
+// write rows of tab separated columns to the output, aligned
+func printTable(rows [][]string) (err error) {
+
+	w := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	for _, row := range rows {
+		if _, err := fmt.Fprintln(w, strings.Join(row, "\t")); err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCommand(t *testing.T) {
+
+	name, args := parseCommand([]string{})
+	assert.Equal(t, "collect", name, "default command")
+	assert.Empty(t, args, "default args")
+
+	name, args = parseCommand([]string{"--debug"})
+	assert.Equal(t, "collect", name, "flags only")
+	assert.Equal(t, []string{"--debug"}, args, "flags only args")
+
+	name, args = parseCommand([]string{"show-resource", "--debug", "abc123"})
+	assert.Equal(t, "show-resource", name, "named command")
+	assert.Equal(t, []string{"--debug", "abc123"}, args, "named command args")
+
+}
+
+func TestBindFlags(t *testing.T) {
+
+	// restore the config from file once done
+	defer func() {
+		viper.Reset()
+		assert.NoError(t, loadConfig())
+	}()
+
+	flags := newFlagSet("collect")
+	if err := flags.Parse([]string{"--host", "https://vrops.test.pdxfixit.com", "--page-size", "10", "--resource-kinds", "HostSystem,VirtualMachine"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bindFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "https://vrops.test.pdxfixit.com", config.Vrops.Host, "host overridden")
+	assert.Equal(t, 10, config.Vrops.PageSize, "page size overridden")
+	assert.Equal(t, []string{"HostSystem", "VirtualMachine"}, config.Vrops.ResourceKindKeys, "resource kinds overridden")
+	assert.Equal(t, "username", config.Vrops.User, "user from config file")
+
+}
+
+// a fake vrops, which will answer for a session token, adapters and properties
+func testVropsServer(t *testing.T) *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		var response string
+		switch {
+		case r.URL.Path == "/suite-api/api/auth/token/acquire":
+			response = "{\"token\":\"test-token\",\"validity\":1546127294284,\"expiresAt\":\"Tuesday, January 1, 2019 0:00:00 AM UTC\",\"roles\":[]}"
+		case r.URL.Path == "/suite-api/api/adapters":
+			response = fmt.Sprintf("{\"adapterInstancesInfoDto\":[{\"resourceKey\":{\"name\":\"Test Adapter\",\"adapterKindKey\":\"VMWARE\",\"resourceKindKey\":\"VMwareAdapter Instance\",\"resourceIdentifiers\":[{\"identifierType\":{\"name\":\"VCURL\",\"dataType\":\"STRING\",\"isPartOfUniqueness\":true},\"value\":\"vcenter.test.pdxfixit.com\"}]},\"description\":\"Test Adapter Instance\",\"numberOfResourcesCollected\":1,\"lastHeartbeat\":%d,\"messageFromAdapterInstance\":\"Trust Established.\",\"id\":\"15a4759d-0b2f-4432-bbfd-9a6f4cfab7e4\"}]}", time.Now().UnixNano()/int64(time.Millisecond))
+		case strings.HasSuffix(r.URL.Path, "/resources"):
+			response = "{\"pageInfo\":{\"totalCount\":1,\"page\":0,\"pageSize\":1000},\"links\":[],\"resourceList\":[{\"resourceKey\":{\"name\":\"esx01.test.pdxfixit.com\",\"adapterKindKey\":\"VMWARE\",\"resourceKindKey\":\"HostSystem\",\"resourceIdentifiers\":[]},\"resourceStatusStates\":[],\"identifier\":\"2fb6adf9-7665-4bec-9d53-e49c5a71d63a\"}]}"
+		case strings.HasSuffix(r.URL.Path, "/properties"):
+			response = "{\"resourceId\":\"2fb6adf9-7665-4bec-9d53-e49c5a71d63a\",\"property\":[{\"name\":\"config|name\",\"value\":\"esx01.test.pdxfixit.com\"}]}"
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		if _, err := fmt.Fprint(w, response); err != nil {
+			t.Error(err.Error())
+		}
+
+	}))
+
+}
+
+func TestListAdapters(t *testing.T) {
+
+	ts := testVropsServer(t)
+	defer ts.Close()
+
+	config.Vrops.Host = ts.URL
+
+	buf := &bytes.Buffer{}
+	output = buf
+	defer func() { output = os.Stdout }()
+
+	if err := listAdapters(context.Background(), []string{}); err != nil {
+		t.Errorf("%v", err)
+	}
+
+	assert.Contains(t, buf.String(), "15a4759d-0b2f-4432-bbfd-9a6f4cfab7e4", "adapter id")
+	assert.Contains(t, buf.String(), "vcenter.test.pdxfixit.com", "adapter vcurl")
+	assert.Contains(t, buf.String(), "Test Adapter Instance", "adapter description")
+
+}
+
+func TestShowResource(t *testing.T) {
+
+	ts := testVropsServer(t)
+	defer ts.Close()
+
+	config.Vrops.Host = ts.URL
+
+	buf := &bytes.Buffer{}
+	output = buf
+	defer func() { output = os.Stdout }()
+
+	assert.Error(t, showResource(context.Background(), []string{}), "resource id required")
+
+	if err := showResource(context.Background(), []string{"2fb6adf9-7665-4bec-9d53-e49c5a71d63a"}); err != nil {
+		t.Errorf("%v", err)
+	}
+
+	assert.Contains(t, buf.String(), "config|name", "property name")
+	assert.Contains(t, buf.String(), "esx01.test.pdxfixit.com", "property value")
+
+}
+
+func TestValidateConfig(t *testing.T) {
+
+	buf := &bytes.Buffer{}
+	output = buf
+	defer func() { output = os.Stdout }()
+
+	saved := config
+	defer func() { config = saved }()
+
+	assert.NoError(t, validateConfig(context.Background(), []string{}), "config.yaml is valid")
+
+	config.Vrops.Host = ""
+	config.Vrops.PageSize = 0
+
+	assert.Error(t, validateConfig(context.Background(), []string{}), "invalid config")
+	assert.Contains(t, buf.String(), "vrops.host is required", "host problem")
+	assert.Contains(t, buf.String(), "vrops.pageSize must be at least 1", "page size problem")
+
+}
+
+func TestShowConfig(t *testing.T) {
+
+	buf := &bytes.Buffer{}
+	output = buf
+	defer func() { output = os.Stdout }()
+
+	assert.NoError(t, showConfig(context.Background(), []string{}))
+	assert.Contains(t, buf.String(), "config.yaml\n", "names the files")
+	assert.Contains(t, buf.String(), "host: https://vrops.pdxfixit.com", "settings")
+	assert.NotContains(t, buf.String(), "pass: password", "redacted")
+	assert.Contains(t, buf.String(), "pass: "+redacted, "redacted")
+
+	assert.Error(t, showConfig(context.Background(), []string{"vrops"}), "no arguments")
+
+}
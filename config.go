@@ -1,44 +1,477 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
 var config globalConfig
 
-func loadConfig() {
+// config files given with --config, each layered over those before it; otherwise config.yaml is searched for
+var configFiles []string
 
-	log.Println("Loading configuration...")
+// an environment, e.g. prod, whose config.<env>.yaml is layered over the config files
+var configEnv string
 
-	// load the config
-	viper.SetConfigName("config")
-	viper.AddConfigPath("/etc/hostdb-collector-vrops")
-	viper.AddConfigPath(".")
+// the config files which were loaded, in order
+var configFilesUsed []string
+
+func loadConfig() (err error) {
+
+	log.Info("Loading configuration...")
 
 	// load env vars
 	viper.SetEnvPrefix("hostdb_collector_vrops")
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
 
-	// read the config file, and handle any errors
+	// the *_FILE variables work, even when the config file doesn't mention them
+	for _, key := range []string{"hostdb.pass_file", "secrets.vault.token_file", "vrops.pass_file"} {
+		if err := viper.BindEnv(key); err != nil {
+			return err
+		}
+	}
+
+	// read the config files, and handle any errors
+	used, err := readConfigFiles()
+	if err != nil {
+		return fmt.Errorf("fatal error config file: %s", err)
+	}
+	configFilesUsed = used
+	log.Infof("Loaded configuration from %s", strings.Join(used, ", "))
+
+	// unmarshal into a fresh struct, so nothing lingers from a previous load
+	loaded := globalConfig{}
+	if err := viper.Unmarshal(&loaded); err != nil {
+		return fmt.Errorf("unable to decode into struct, %v", err)
+	}
+	config = loaded
+
+	// make sure the credentials never make it into the logs
+	registerSecret(config.Vrops.Pass)
+	registerSecret(config.Hostdb.Pass)
+	registerSecret(config.Secrets.Vault.Token)
+	for _, sc := range config.Collector.Sinks {
+		for _, v := range sc.Headers {
+			registerSecret(v)
+		}
+	}
+
+	// a bad log level or format is reported by Validate, along with everything else
+	if err := configureLogging(); err != nil {
+		log.WithError(err).Warn("Unable to configure logging.")
+	}
+
+	if err := configureTransport(); err != nil {
+		return fmt.Errorf("unable to configure the http transport, %v", err)
+	}
+
+	// debug; not the whole environment, which is none of our business
+	log.Debugf("%+v", config)
+
+	return nil
+
+}
+
+// read the base config file, then merge any overlays over it, returning the files read
+func readConfigFiles() (used []string, err error) {
+
+	// the environment is a fallback for the flags, e.g. in a container
+	files := configFiles
+	if len(files) == 0 && os.Getenv("HOSTDB_COLLECTOR_VROPS_CONFIG") != "" {
+		files = strings.Split(os.Getenv("HOSTDB_COLLECTOR_VROPS_CONFIG"), ",")
+	}
+	env := configEnv
+	if env == "" {
+		env = os.Getenv("HOSTDB_COLLECTOR_VROPS_ENV")
+	}
+
+	if len(files) > 0 {
+		viper.SetConfigFile(files[0])
+	} else {
+		viper.SetConfigName("config")
+		viper.AddConfigPath("/etc/hostdb-collector-vrops")
+		viper.AddConfigPath(".")
+	}
+
 	if err := viper.ReadInConfig(); err != nil {
-		log.Fatal(fmt.Errorf("fatal error config file: %s", err))
+		return nil, err
+	}
+	base := viper.ConfigFileUsed()
+	used = append(used, base)
+
+	var overlays []string
+	if len(files) > 1 {
+		overlays = append(overlays, files[1:]...)
+	}
+	if env != "" {
+		overlays = append(overlays, envConfigFile(base, env))
+	}
+
+	// maps are merged key by key; anything else, lists included, is replaced
+	for _, overlay := range overlays {
+		viper.SetConfigFile(overlay)
+		if err := viper.MergeInConfig(); err != nil {
+			return nil, fmt.Errorf("%s: %v", overlay, err)
+		}
+		used = append(used, overlay)
+	}
+
+	// so that reloading starts from the base again
+	viper.SetConfigFile(base)
+
+	return used, nil
+
+}
+
+// the overlay for an environment sits beside the base file, e.g. config.yaml and config.prod.yaml
+func envConfigFile(base string, env string) string {
+
+	ext := filepath.Ext(base)
+
+	return fmt.Sprintf("%s.%s%s", strings.TrimSuffix(base, ext), env, ext)
+
+}
+
+// check the loaded configuration for problems which would otherwise surface mid-run
+func (c globalConfig) Validate() (errs []error) {
+
+	if _, err := log.ParseLevel(c.Collector.LogLevel); c.Collector.LogLevel != "" && err != nil {
+		errs = append(errs, fmt.Errorf("collector.log_level must be debug, info, warn or error, not %q", c.Collector.LogLevel))
+	}
+
+	switch c.Collector.LogFormat {
+	case "", "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("collector.log_format must be text or json, not %q", c.Collector.LogFormat))
+	}
+
+	switch c.Daemon.Shutdown {
+	case "", "finish", "abandon":
+	default:
+		errs = append(errs, fmt.Errorf("daemon.shutdown must be finish or abandon, not %q", c.Daemon.Shutdown))
+	}
+
+	if c.Daemon.ShutdownTimeout < 0 {
+		errs = append(errs, fmt.Errorf("daemon.shutdown_timeout can't be negative, not %s", c.Daemon.ShutdownTimeout))
+	}
+
+	if c.Health.MaxHeartbeatAge < 0 {
+		errs = append(errs, fmt.Errorf("health.max_heartbeat_age can't be negative, not %s", c.Health.MaxHeartbeatAge))
+	}
+
+	if c.Health.MinResources < 0 {
+		errs = append(errs, fmt.Errorf("health.min_resources can't be negative, not %d", c.Health.MinResources))
+	}
+
+	if c.Health.MinResourceRatio < 0 || c.Health.MinResourceRatio > 1 {
+		errs = append(errs, fmt.Errorf("health.min_resource_ratio must be between 0 and 1, not %g", c.Health.MinResourceRatio))
+	}
+
+	if c.Daemon.Schedule != "" {
+		if _, err := cron.ParseStandard(c.Daemon.Schedule); err != nil {
+			errs = append(errs, fmt.Errorf("daemon.schedule %q is invalid: %v", c.Daemon.Schedule, err))
+		}
+	}
+
+	for i, schedule := range c.Daemon.Adapters {
+		if len(schedule.Include) == 0 {
+			errs = append(errs, fmt.Errorf("daemon.adapters[%d].include must list at least one adapter", i))
+		}
+		if _, err := cron.ParseStandard(schedule.Schedule); err != nil {
+			errs = append(errs, fmt.Errorf("daemon.adapters[%d].schedule %q is invalid: %v", i, schedule.Schedule, err))
+		}
+	}
+
+	for _, key := range recordSetContextKeys {
+		if _, ok := c.Collector.Context[key]; ok {
+			errs = append(errs, fmt.Errorf("collector.context.%s is set by the collector, and can't be configured", key))
+		}
 	}
 
-	// unmarshal into our struct
-	if err := viper.Unmarshal(&config); err != nil {
-		log.Fatal(fmt.Errorf("unable to decode into struct, %v", err))
+	switch c.Collector.Duplicates {
+	case "", duplicatesOff, duplicatesMark, duplicatesDrop:
+	default:
+		errs = append(errs, fmt.Errorf("collector.duplicates must be %s, %s or %s, not %q", duplicatesMark, duplicatesDrop, duplicatesOff, c.Collector.Duplicates))
 	}
 
-	// debug
-	if config.Collector.Debug {
-		log.Println(fmt.Sprintf("%v", os.Environ()))
-		log.Println(fmt.Sprintf("%v", config))
+	switch c.Collector.Stale.Policy {
+	case "", staleKeep, staleFlag, staleDrop, staleSeparate:
+	default:
+		errs = append(errs, fmt.Errorf("collector.stale.policy must be %s, %s, %s or %s, not %q", staleKeep, staleFlag, staleDrop, staleSeparate, c.Collector.Stale.Policy))
 	}
 
+	switch c.Collector.Timestamp {
+	case "", timestampCollected, timestampVrops:
+	default:
+		errs = append(errs, fmt.Errorf("collector.timestamp must be %s or %s, not %q", timestampCollected, timestampVrops, c.Collector.Timestamp))
+	}
+
+	switch c.Collector.RecordID {
+	case "", recordIDIdentifier, recordIDUUID:
+	default:
+		errs = append(errs, fmt.Errorf("collector.record_id must be %s or %s, not %q", recordIDIdentifier, recordIDUUID, c.Collector.RecordID))
+	}
+
+	if c.Collector.RequestTimeout < 0 {
+		errs = append(errs, fmt.Errorf("collector.request_timeout can't be negative, not %s", c.Collector.RequestTimeout))
+	}
+
+	if c.Collector.RunTimeout < 0 {
+		errs = append(errs, fmt.Errorf("collector.run_timeout can't be negative, not %s", c.Collector.RunTimeout))
+	}
+
+	if c.HTTP.IdleConnTimeout < 0 {
+		errs = append(errs, fmt.Errorf("http.idle_conn_timeout can't be negative, not %s", c.HTTP.IdleConnTimeout))
+	}
+
+	if c.HTTP.MaxIdleConnsPerHost < 0 {
+		errs = append(errs, fmt.Errorf("http.max_idle_conns_per_host can't be negative, not %d", c.HTTP.MaxIdleConnsPerHost))
+	}
+
+	if c.HTTP.Proxy != "" {
+		if _, err := url.ParseRequestURI(c.HTTP.Proxy); err != nil {
+			errs = append(errs, fmt.Errorf("http.proxy is not a valid URL: %v", err))
+		}
+	}
+
+	if c.Hostdb.URL != "" {
+		if err := checkURL("hostdb.url", c.Hostdb.URL); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if c.Hostdb.User != "" && c.Hostdb.Pass == "" && c.Hostdb.PassFile == "" && c.Hostdb.PassSecret == "" {
+		errs = append(errs, errors.New("hostdb.pass, hostdb.pass_file or hostdb.pass_secret is required with hostdb.user"))
+	}
+
+	if c.Hostdb.ChunkBytes < 0 {
+		errs = append(errs, fmt.Errorf("hostdb.chunk_bytes can't be negative, not %d", c.Hostdb.ChunkBytes))
+	}
+
+	if c.Hostdb.ChunkRecords < 0 {
+		errs = append(errs, fmt.Errorf("hostdb.chunk_records can't be negative, not %d", c.Hostdb.ChunkRecords))
+	}
+
+	if c.Metrics.Pushgateway != "" {
+		if err := checkURL("metrics.pushgateway", c.Metrics.Pushgateway); err != nil {
+			errs = append(errs, err)
+		}
+		if c.Metrics.Job == "" {
+			errs = append(errs, errors.New("metrics.job is required when pushing metrics"))
+		}
+	}
+
+	if c.Vrops.Host == "" {
+		errs = append(errs, errors.New("vrops.host is required"))
+	} else if err := checkURL("vrops.host", c.Vrops.Host); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.Vrops.User == "" {
+		errs = append(errs, errors.New("vrops.user is required"))
+	}
+
+	if c.Vrops.Pass == "" && c.Vrops.PassFile == "" && c.Vrops.PassSecret == "" {
+		errs = append(errs, errors.New("vrops.pass, vrops.pass_file or vrops.pass_secret is required"))
+	}
+
+	if _, err := newSecretProvider(c.Secrets); err != nil {
+		errs = append(errs, fmt.Errorf("secrets: %v", err))
+	} else if c.Secrets.Provider == "vault" {
+		if err := checkURL("secrets.vault.url", c.Secrets.Vault.URL); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, secret := range []struct{ key, ref string }{
+		{"hostdb.pass_secret", c.Hostdb.PassSecret},
+		{"vrops.pass_secret", c.Vrops.PassSecret},
+	} {
+		if secret.ref == "" {
+			continue
+		}
+		if c.Secrets.Provider == "" {
+			errs = append(errs, fmt.Errorf("%s requires secrets.provider", secret.key))
+		}
+		if _, _, err := splitSecretRef(secret.ref); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", secret.key, err))
+		}
+	}
+
+	if c.Vrops.PageSize < 1 {
+		errs = append(errs, fmt.Errorf("vrops.pageSize must be at least 1, not %d", c.Vrops.PageSize))
+	}
+
+	if c.Vrops.PageSize > maxPageSize {
+		errs = append(errs, fmt.Errorf("vrops.pageSize can't be more than %d, not %d", maxPageSize, c.Vrops.PageSize))
+	}
+
+	if len(c.Vrops.ResourceKindKeys) == 0 {
+		errs = append(errs, errors.New("vrops.resourceKindKeys must list at least one resource kind"))
+	}
+
+	for _, kind := range c.Vrops.ResourceKindKeys {
+		if !knownResourceKind(kind) {
+			errs = append(errs, fmt.Errorf("vrops.resourceKindKeys has an unknown resource kind %q", kind))
+		}
+	}
+
+	for _, pattern := range append(append([]string{}, c.Collector.Include...), c.Collector.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("collector include/exclude pattern %q is invalid: %v", pattern, err))
+		}
+	}
+
+	for i, sc := range c.Collector.Sinks {
+		if _, err := newSink(sc); err != nil {
+			errs = append(errs, fmt.Errorf("collector.sinks[%d]: %v", i, err))
+		} else if sc.Type == "webhook" {
+			if err := checkURL(fmt.Sprintf("collector.sinks[%d].url", i), sc.URL); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if c.Collector.Diff && c.Collector.Stream != "" {
+		errs = append(errs, errors.New("collector.diff can't be used with collector.stream, as streamed records aren't kept"))
+	}
+
+	if c.Collector.Diff && c.Collector.SnapshotDir == "" {
+		errs = append(errs, errors.New("collector.snapshot_dir is required when collector.diff is enabled"))
+	}
+
+	return errs
+
+}
+
+// anything in the config files, flags or environment which doesn't correspond to a setting, e.g. a typo
+func unknownKeys() (errs []error) {
+
+	err := viper.UnmarshalExact(&globalConfig{})
+	if err == nil {
+		return nil
+	}
+
+	// e.g. * 'collector' has invalid keys: sample_date, sinks
+	for _, match := range invalidKeys.FindAllStringSubmatch(err.Error(), -1) {
+		for _, key := range strings.Split(match[2], ", ") {
+			if match[1] != "" {
+				key = fmt.Sprintf("%s.%s", match[1], key)
+			}
+			errs = append(errs, fmt.Errorf("%s is not a known setting", key))
+		}
+	}
+
+	// anything else would already have stopped the config from loading
+	if len(errs) == 0 {
+		errs = append(errs, err)
+	}
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+
+	return errs
+
+}
+
+var invalidKeys = regexp.MustCompile(`'([^']*)' has invalid keys: (.*)`)
+
+// every problem with the configuration, all at once
+func configProblems() []error {
+
+	return append(unknownKeys(), config.Validate()...)
+
+}
+
+// an http or https url, with a host
+func checkURL(key string, value string) error {
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid URL: %v", key, err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s must be an http or https URL, not %q", key, value)
+	}
+
+	return nil
+
+}
+
+// log any problems with the configuration, failing if there are any
+func checkConfig() error {
+
+	errs := configProblems()
+	for _, problem := range errs {
+		log.Error(problem)
+	}
+
+	if len(errs) > 0 {
+		return withExitCode(exitConfig, fmt.Errorf("found %d problems with the configuration", len(errs)))
+	}
+
+	return nil
+
+}
+
+// settings which hold credentials; header values usually do too
+var secretSettings = map[string]bool{"headers": true, "pass": true, "token": true}
+
+// the effective configuration, after merging files, environment and flags, with the secrets redacted
+func effectiveConfig() map[string]interface{} {
+
+	return redactSettings(viper.AllSettings(), false).(map[string]interface{})
+
+}
+
+func redactSettings(value interface{}, secret bool) interface{} {
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		settings := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			settings[key] = redactSettings(item, secret || secretSettings[strings.ToLower(key)])
+		}
+		return settings
+	case map[interface{}]interface{}:
+		// e.g. sinks, decoded from yaml lists
+		settings := make(map[interface{}]interface{}, len(v))
+		for key, item := range v {
+			settings[key] = redactSettings(item, secret || secretSettings[strings.ToLower(fmt.Sprint(key))])
+		}
+		return settings
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = redactSettings(item, secret)
+		}
+		return items
+	case string:
+		if secret && v != "" {
+			return redacted
+		}
+		// a credential may turn up elsewhere, e.g. in a proxy url, which redact's patterns catch
+		return redact(v)
+	case nil:
+		return nil
+	}
+
+	if secret {
+		return redacted
+	}
+
+	return value
+
 }
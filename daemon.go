@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// set when shutting down; checked between adapters, and between pages
+var shutdown int32
+
+const (
+	shutdownNone int32 = iota
+	shutdownFinish
+	shutdownAbandon
+)
+
+// only one collection runs at a time, whatever its schedule, as they share the session, run id and byte counters
+var collecting int32
+
+// a scheduled collection, which is skipped if another is still running
+func scheduledCollection(ctx context.Context, name string, sinks []sink, selected func(vropsAdapterInstance) bool) func() {
+
+	return func() {
+
+		if !atomic.CompareAndSwapInt32(&collecting, 0, 1) {
+			log.Warnf("Skipping the %s collection, as a previous collection is still running.", name)
+			skippedCollections.WithLabelValues(name).Inc()
+			return
+		}
+		defer atomic.StoreInt32(&collecting, 0)
+
+		log.Infof("Starting the %s collection...", name)
+		if err := collectAdapters(ctx, sinks, selected); err != nil {
+			log.WithError(err).Errorf("The %s collection failed.", name)
+		}
+
+	}
+
+}
+
+// the adapters which belong to the default schedule, i.e. those without a schedule of their own
+func defaultScheduleSelected(adapter vropsAdapterInstance) bool {
+
+	if !adapterSelected(adapter) {
+		return false
+	}
+
+	for _, schedule := range config.Daemon.Adapters {
+		if adapterMatches(adapter, schedule.Include) {
+			return false
+		}
+	}
+
+	return true
+
+}
+
+// build the scheduler from config
+func newScheduler(ctx context.Context, sinks []sink) (scheduler *cron.Cron, err error) {
+
+	scheduler = cron.New()
+
+	if config.Daemon.Schedule != "" {
+		if _, err := scheduler.AddFunc(config.Daemon.Schedule, scheduledCollection(ctx, "default", sinks, defaultScheduleSelected)); err != nil {
+			return nil, fmt.Errorf("daemon.schedule: %v", err)
+		}
+	}
+
+	for i, schedule := range config.Daemon.Adapters {
+		include := schedule.Include
+		selected := func(adapter vropsAdapterInstance) bool {
+			return adapterSelected(adapter) && adapterMatches(adapter, include)
+		}
+		if _, err := scheduler.AddFunc(schedule.Schedule, scheduledCollection(ctx, fmt.Sprintf("%v", include), sinks, selected)); err != nil {
+			return nil, fmt.Errorf("daemon.adapters[%d].schedule: %v", i, err)
+		}
+	}
+
+	if len(scheduler.Entries()) == 0 {
+		return nil, fmt.Errorf("no schedules are configured")
+	}
+
+	return scheduler, nil
+
+}
+
+// daemon
+func daemon(ctx context.Context, args []string) (err error) {
+
+	if len(args) > 0 {
+		return withExitCode(exitUsage, fmt.Errorf("unexpected arguments: %v", args))
+	}
+
+	if err := checkConfig(); err != nil {
+		return err
+	}
+
+	sinks, err := configuredSinks()
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+
+	// the collections outlive ctx, so that on shutdown they can be allowed to finish
+	collections, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	scheduler, err := newScheduler(collections, sinks)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+
+	if config.Metrics.Listen != "" {
+		go serveMetrics(config.Metrics.Listen)
+	}
+
+	scheduler.Start()
+	log.Infof("Running as a daemon with %d schedules.", len(scheduler.Entries()))
+
+	if config.Daemon.RunOnStart {
+		go scheduledCollection(collections, "startup", sinks, adapterSelected)()
+	}
+
+	<-ctx.Done()
+	log.Info("Shutting down...")
+
+	// a second signal gives up on anything in flight
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	mode := shutdownFinish
+	if config.Daemon.Shutdown == "abandon" {
+		mode = shutdownAbandon
+		cancel()
+	}
+	atomic.StoreInt32(&shutdown, mode)
+
+	// stop scheduling, and wait for anything in flight; a zero timeout waits as long as it takes
+	scheduler.Stop()
+
+	var timeout <-chan time.Time
+	if config.Daemon.ShutdownTimeout > 0 {
+		timeout = time.After(config.Daemon.ShutdownTimeout)
+	}
+
+	for atomic.LoadInt32(&collecting) != 0 {
+		select {
+		case <-timeout:
+			return fmt.Errorf("timed out waiting for the collection to finish")
+		case sig := <-signals:
+			return fmt.Errorf("received %s while waiting for the collection to finish", sig)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	log.Info("All done!")
+
+	return nil
+
+}
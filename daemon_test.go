@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultScheduleSelected(t *testing.T) {
+
+	saved := config
+	defer func() { config = saved }()
+
+	config.Collector.Include = nil
+	config.Collector.Exclude = nil
+	config.Daemon.Adapters = []adapterScheduleConfig{
+		{Include: []string{"vcenter01.test.pdxfixit.com"}, Schedule: "@every 1h"},
+	}
+
+	scheduled := vropsAdapterInstance{ID: "1", ResourceKey: vropsResourceKey{Name: "vcenter01.test.pdxfixit.com"}}
+	other := vropsAdapterInstance{ID: "2", ResourceKey: vropsResourceKey{Name: "vcenter02.test.pdxfixit.com"}}
+
+	assert.False(t, defaultScheduleSelected(scheduled), "has its own schedule")
+	assert.True(t, defaultScheduleSelected(other), "default schedule")
+
+	config.Collector.Exclude = []string{"vcenter02.test.pdxfixit.com"}
+	assert.False(t, defaultScheduleSelected(other), "excluded")
+
+}
+
+func TestNewScheduler(t *testing.T) {
+
+	saved := config
+	defer func() { config = saved }()
+
+	config.Daemon.Schedule = ""
+	config.Daemon.Adapters = nil
+	_, err := newScheduler(context.Background(), nil)
+	assert.Error(t, err, "no schedules")
+
+	config.Daemon.Schedule = "not a schedule"
+	_, err = newScheduler(context.Background(), nil)
+	assert.Error(t, err, "bad schedule")
+
+	config.Daemon.Schedule = "0 */4 * * *"
+	config.Daemon.Adapters = []adapterScheduleConfig{
+		{Include: []string{"vcenter01.test.pdxfixit.com"}, Schedule: "@every 1h"},
+	}
+	scheduler, err := newScheduler(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Len(t, scheduler.Entries(), 2, "default and per-adapter schedules")
+
+}
+
+func TestScheduledCollectionOverlap(t *testing.T) {
+
+	// pretend a collection is already running; if this one ran, it would try to reach vrops and fail loudly
+	atomic.StoreInt32(&collecting, 1)
+	defer atomic.StoreInt32(&collecting, 0)
+
+	skippedCollections.Reset()
+	scheduledCollection(context.Background(), "test", nil, adapterSelected)()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&collecting), "still owned by the running collection")
+	assert.Equal(t, float64(1), testutil.ToFloat64(skippedCollections.WithLabelValues("test")), "counted as skipped")
+
+}
+
+func TestCollectAdaptersShutdown(t *testing.T) {
+
+	ts := testVropsServer(t)
+	defer ts.Close()
+
+	saved := config
+	defer func() { config = saved }()
+
+	config.Vrops.Host = ts.URL
+	config.Vrops.PageSize = 1000
+	config.Vrops.ResourceKindKeys = []string{"HostSystem"}
+	config.Collector.Include = nil
+	config.Collector.Exclude = nil
+	config.Collector.Stream = ""
+	config.Hostdb.SpoolDir = ""
+
+	buf := &bytes.Buffer{}
+	output = buf
+	defer func() { output = os.Stdout }()
+
+	// running normally, the adapter is collected
+	assert.NoError(t, collectAdapters(context.Background(), []sink{stdoutSink{}}, adapterSelected))
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"), "one recordset")
+	assert.Contains(t, buf.String(), "vrops-vmware-hostsystem", "record")
+
+	// once shutting down, no more adapters are started
+	buf.Reset()
+	atomic.StoreInt32(&shutdown, shutdownFinish)
+	defer atomic.StoreInt32(&shutdown, shutdownNone)
+
+	assert.NoError(t, collectAdapters(context.Background(), []sink{stdoutSink{}}, adapterSelected))
+	assert.Empty(t, buf.String(), "nothing collected")
+
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pdxfixit/hostdb"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	identifier: 2fb64df9-7665-4bec-9d53-e49c5a71563a
+	type:       vrops-vmware-virtualmachine
+	hostname:   foo.pdxfixit.com
+	properties: [ summary|guest|ipAddress ]
+*/
+type resourceDiff struct {
+	Identifier string   `json:"identifier"`
+	Type       string   `json:"type"`
+	Hostname   string   `json:"hostname,omitempty"`
+	Properties []string `json:"properties,omitempty"`
+}
+
+/*
+	vc_url:   vcenter.pdxfixit.com
+	previous: 2019-01-01 00:00:00
+	current:  2019-01-02 00:00:00
+	added:    []
+	removed:  []
+	changed:  []
+*/
+type recordSetDiff struct {
+	VcURL    string         `json:"vc_url"`
+	Previous string         `json:"previous"`
+	Current  string         `json:"current"`
+	Added    []resourceDiff `json:"added"`
+	Removed  []resourceDiff `json:"removed"`
+	Changed  []resourceDiff `json:"changed"`
+}
+
+// a human-readable rendering of the diff, suitable for logging
+func (d recordSetDiff) String() string {
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Diff for %s (%s -> %s): %d added, %d removed, %d changed\n",
+		d.VcURL,
+		d.Previous,
+		d.Current,
+		len(d.Added),
+		len(d.Removed),
+		len(d.Changed),
+	)
+
+	for _, r := range d.Added {
+		fmt.Fprintf(&b, "  + %s %s %s\n", r.Type, r.Identifier, r.Hostname)
+	}
+
+	for _, r := range d.Removed {
+		fmt.Fprintf(&b, "  - %s %s %s\n", r.Type, r.Identifier, r.Hostname)
+	}
+
+	for _, r := range d.Changed {
+		fmt.Fprintf(&b, "  ~ %s %s %s [%s]\n", r.Type, r.Identifier, r.Hostname, strings.Join(r.Properties, ", "))
+	}
+
+	return strings.TrimRight(b.String(), "\n")
+
+}
+
+// compare two recordsets, keyed by the vrops resource identifier
+func diffRecordSets(previous hostdb.RecordSet, current hostdb.RecordSet) (diff recordSetDiff, err error) {
+
+	diff = recordSetDiff{
+		Previous: previous.Timestamp,
+		Current:  current.Timestamp,
+		Added:    []resourceDiff{},
+		Removed:  []resourceDiff{},
+		Changed:  []resourceDiff{},
+	}
+
+	if vcURL, ok := current.Context["vc_url"].(string); ok {
+		diff.VcURL = vcURL
+	}
+
+	before, err := indexRecords(previous.Records)
+	if err != nil {
+		return recordSetDiff{}, err
+	}
+
+	after, err := indexRecords(current.Records)
+	if err != nil {
+		return recordSetDiff{}, err
+	}
+
+	for id, now := range after {
+
+		then, ok := before[id]
+		if !ok {
+			diff.Added = append(diff.Added, now.resourceDiff(nil))
+			continue
+		}
+
+		if changed := changedProperties(then.properties, now.properties); len(changed) > 0 {
+			diff.Changed = append(diff.Changed, now.resourceDiff(changed))
+		}
+
+	}
+
+	for id, then := range before {
+		if _, ok := after[id]; !ok {
+			diff.Removed = append(diff.Removed, then.resourceDiff(nil))
+		}
+	}
+
+	sortResourceDiffs(diff.Added)
+	sortResourceDiffs(diff.Removed)
+	sortResourceDiffs(diff.Changed)
+
+	return diff, nil
+
+}
+
+// a record, broken back out into its vrops properties
+type indexedRecord struct {
+	record     hostdb.Record
+	identifier string
+	properties map[string]string
+}
+
+func (r indexedRecord) resourceDiff(properties []string) resourceDiff {
+
+	return resourceDiff{
+		Identifier: r.identifier,
+		Type:       r.record.Type,
+		Hostname:   r.record.Hostname,
+		Properties: properties,
+	}
+
+}
+
+// map each record by the vrops resource identifier held in its data
+func indexRecords(records []hostdb.Record) (index map[string]indexedRecord, err error) {
+
+	index = map[string]indexedRecord{}
+
+	for _, record := range records {
+
+		properties := vropsResourceProperties{}
+		if err := json.Unmarshal(record.Data, &properties); err != nil {
+			return nil, err
+		}
+
+		values := map[string]string{}
+		for _, property := range properties.Property {
+			values[property.Name] = property.Value
+		}
+
+		index[properties.ResourceID] = indexedRecord{
+			record:     record,
+			identifier: properties.ResourceID,
+			properties: values,
+		}
+
+	}
+
+	return index, nil
+
+}
+
+// list the names of any properties which were added, removed or changed
+func changedProperties(before map[string]string, after map[string]string) (names []string) {
+
+	for name, value := range after {
+		if previous, ok := before[name]; !ok || previous != value {
+			names = append(names, name)
+		}
+	}
+
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+
+}
+
+func sortResourceDiffs(diffs []resourceDiff) {
+
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Type != diffs[j].Type {
+			return diffs[i].Type < diffs[j].Type
+		}
+		return diffs[i].Identifier < diffs[j].Identifier
+	})
+
+}
+
+// where the snapshot of the vcenter's recordset from the last complete run is kept
+func snapshotPath(recordSet hostdb.RecordSet) string {
+
+	return filepath.Join(config.Collector.SnapshotDir, fmt.Sprintf("%s.json", recordSet.Context["vc_url"]))
+
+}
+
+// compare the recordset against the previous run, and report the differences
+func reportDiff(recordSet hostdb.RecordSet) (err error) {
+
+	name := fmt.Sprintf("%s", recordSet.Context["vc_url"])
+
+	previous, err := readRecordSetFile(snapshotPath(recordSet))
+	if os.IsNotExist(err) {
+		log.Infof("No previous snapshot for %s, nothing to compare.", name)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	diff, err := diffRecordSets(previous, recordSet)
+	if err != nil {
+		return err
+	}
+
+	log.Info(diff.String())
+
+	data, err := json.MarshalIndent(diff, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(config.Collector.SnapshotDir, 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(config.Collector.SnapshotDir, fmt.Sprintf("%s.diff.json", name)), data, 0644)
+
+}
+
+// save the recordset for the next run to compare against
+// only a complete, delivered recordset should be saved, or the next run will see resources come and go which never did
+func saveSnapshot(recordSet hostdb.RecordSet) error {
+
+	if err := os.MkdirAll(config.Collector.SnapshotDir, 0755); err != nil {
+		return err
+	}
+
+	return writeRecordSetFile(snapshotPath(recordSet), recordSet)
+
+}
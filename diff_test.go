@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pdxfixit/hostdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func testDiffRecord(id string, properties map[string]string) hostdb.Record {
+
+	resourceProperties := vropsResourceProperties{ResourceID: id}
+	for name, value := range properties {
+		resourceProperties.Property = append(resourceProperties.Property, vropsProperty{Name: name, Value: value})
+	}
+
+	data, _ := json.Marshal(resourceProperties)
+
+	return hostdb.Record{
+		Type:      "vrops-vmware-virtualmachine",
+		Hostname:  id + ".pdxfixit.com",
+		Committer: "golang tests",
+		Data:      data,
+	}
+
+}
+
+func TestDiffRecordSets(t *testing.T) {
+
+	previous := hostdb.RecordSet{
+		Timestamp: "2019-01-01 00:00:00",
+		Context:   map[string]interface{}{"vc_url": "vcenter.test.pdxfixit.com"},
+		Records: []hostdb.Record{
+			testDiffRecord("same", map[string]string{"a": "1"}),
+			testDiffRecord("changed", map[string]string{"a": "1", "b": "2", "c": "3"}),
+			testDiffRecord("removed", map[string]string{"a": "1"}),
+		},
+	}
+
+	current := hostdb.RecordSet{
+		Timestamp: "2019-01-02 00:00:00",
+		Context:   map[string]interface{}{"vc_url": "vcenter.test.pdxfixit.com"},
+		Records: []hostdb.Record{
+			testDiffRecord("same", map[string]string{"a": "1"}),
+			testDiffRecord("changed", map[string]string{"a": "1", "b": "20", "d": "4"}),
+			testDiffRecord("added", map[string]string{"a": "1"}),
+		},
+	}
+
+	diff, err := diffRecordSets(previous, current)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	assert.Equal(t, "vcenter.test.pdxfixit.com", diff.VcURL, "vc_url")
+	assert.Equal(t, "2019-01-01 00:00:00", diff.Previous, "previous")
+	assert.Equal(t, "2019-01-02 00:00:00", diff.Current, "current")
+	assert.Len(t, diff.Added, 1, "added count")
+	assert.Equal(t, "added", diff.Added[0].Identifier, "added identifier")
+	assert.Len(t, diff.Removed, 1, "removed count")
+	assert.Equal(t, "removed", diff.Removed[0].Identifier, "removed identifier")
+	assert.Len(t, diff.Changed, 1, "changed count")
+	assert.Equal(t, "changed", diff.Changed[0].Identifier, "changed identifier")
+	assert.Equal(t, []string{"b", "c", "d"}, diff.Changed[0].Properties, "changed properties")
+
+	assert.Contains(t, diff.String(), "1 added, 1 removed, 1 changed")
+	assert.Contains(t, diff.String(), "~ vrops-vmware-virtualmachine changed changed.pdxfixit.com [b, c, d]")
+
+}
+
+func TestReportDiff(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hostdb-collector-vrops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	config.Collector.SnapshotDir = dir
+
+	recordSet := hostdb.RecordSet{
+		Timestamp: "2019-01-01 00:00:00",
+		Context:   map[string]interface{}{"vc_url": "vcenter.test.pdxfixit.com"},
+		Records:   []hostdb.Record{testDiffRecord("foo", map[string]string{"a": "1"})},
+	}
+
+	// first run, no previous snapshot
+	assert.NoError(t, reportDiff(recordSet))
+	_, err = os.Stat(filepath.Join(dir, "vcenter.test.pdxfixit.com.diff.json"))
+	assert.True(t, os.IsNotExist(err), "nothing to compare")
+	assert.NoError(t, saveSnapshot(recordSet))
+	assert.FileExists(t, filepath.Join(dir, "vcenter.test.pdxfixit.com.json"), "snapshot")
+
+	// second run, compare with the first
+	recordSet.Records = append(recordSet.Records, testDiffRecord("bar", map[string]string{"a": "1"}))
+	assert.NoError(t, reportDiff(recordSet))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "vcenter.test.pdxfixit.com.diff.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff := recordSetDiff{}
+	if err := json.Unmarshal(data, &diff); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, diff.Added, 1, "added count")
+	assert.Equal(t, "bar", diff.Added[0].Identifier, "added identifier")
+	assert.Empty(t, diff.Removed, "removed")
+	assert.Empty(t, diff.Changed, "changed")
+
+}
+
+func TestCollectAdaptersSnapshot(t *testing.T) {
+
+	ts := testVropsServer(t)
+	defer ts.Close()
+
+	// the adapter has two pages of resources, and the second can't be listed
+	partial := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/resources") {
+			ts.Config.Handler.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Query().Get("page") != "0" {
+			http.Error(w, "oops", http.StatusInternalServerError)
+			return
+		}
+		rec := httptest.NewRecorder()
+		ts.Config.Handler.ServeHTTP(rec, r)
+		if _, err := w.Write(bytes.Replace(rec.Body.Bytes(), []byte(`"totalCount":1`), []byte(`"totalCount":2`), 1)); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer partial.Close()
+
+	dir, err := ioutil.TempDir("", "hostdb-collector-vrops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { assert.NoError(t, os.RemoveAll(dir)) }()
+
+	saved := config
+	defer func() { config = saved }()
+	testCollectionConfig(ts.URL)
+	config.Collector.Diff = true
+	config.Collector.SnapshotDir = dir
+	snapshot := filepath.Join(dir, "vcenter.test.pdxfixit.com.json")
+
+	buf := &bytes.Buffer{}
+	output = buf
+	defer func() { output = os.Stdout }()
+
+	// not delivered
+	assert.Error(t, collectAdapters(context.Background(), []sink{failingSink{}}, adapterSelected))
+	_, err = os.Stat(snapshot)
+	assert.True(t, os.IsNotExist(err), "no snapshot when undelivered")
+
+	// some pages missing
+	config.Vrops.Host = partial.URL
+	config.Vrops.PageSize = 1
+	assert.Error(t, collectAdapters(context.Background(), []sink{stdoutSink{}}, adapterSelected))
+	_, err = os.Stat(snapshot)
+	assert.True(t, os.IsNotExist(err), "no snapshot when incomplete")
+
+	// complete and delivered
+	config.Vrops.Host = ts.URL
+	config.Vrops.PageSize = 1000
+	assert.NoError(t, collectAdapters(context.Background(), []sink{stdoutSink{}}, adapterSelected))
+	assert.FileExists(t, snapshot, "snapshot")
+
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"strings"
+)
+
+// what to do with a resource which was already collected in this run, through another vCenter or vROps
+const (
+	duplicatesOff  = "off"
+	duplicatesMark = "mark"
+	duplicatesDrop = "drop"
+)
+
+// the properties which identify a machine, wherever it's collected from
+var duplicateProperties = []struct {
+	match      string
+	recordType string
+	property   string
+}{
+	{"instance_uuid", "vrops-vmware-virtualmachine", "config|instanceUuid"},
+	{"bios_uuid", "vrops-vmware-virtualmachine", "config|uuid"},
+	{"bios_uuid", "vrops-vmware-hostsystem", "hardware|systemInfo|uuid"},
+}
+
+/*
+	adapter_id: 15a4759d-0b2f-4432-bbfd-9a6f4cfab7e4
+	identifier: 2fb6adf9-7665-4bec-9d53-e49c5a71d63a
+*/
+type duplicateSource struct {
+	AdapterID  string `json:"adapter_id"`
+	Identifier string `json:"identifier"`
+}
+
+// a key a resource can be recognised by, and how it was derived
+type duplicateKey struct {
+	match string
+	key   string
+}
+
+// every resource delivered so far in a run, by each of its keys
+// the adapter being collected is kept pending until its recordset is going to be delivered
+type duplicateIndex struct {
+	seen    map[string]duplicateSource
+	pending map[string]duplicateSource
+}
+
+func newDuplicateIndex() *duplicateIndex {
+
+	return &duplicateIndex{
+		seen:    map[string]duplicateSource{},
+		pending: map[string]duplicateSource{},
+	}
+
+}
+
+// the adapter's recordset is going to be delivered, so its resources count from now on; safe to call without an index
+func (idx *duplicateIndex) commit() {
+
+	if idx == nil {
+		return
+	}
+
+	for key, source := range idx.pending {
+		if _, ok := idx.seen[key]; !ok {
+			idx.seen[key] = source
+		}
+	}
+	idx.pending = map[string]duplicateSource{}
+
+}
+
+// the adapter's recordset won't be delivered, so its resources mustn't count against anyone else's; safe to call without an index
+func (idx *duplicateIndex) discard() {
+
+	if idx == nil {
+		return
+	}
+
+	idx.pending = map[string]duplicateSource{}
+
+}
+
+// the keys a resource can be recognised by: its uuids, and its managed object reference within its vCenter
+func duplicateKeys(recordType string, resource vropsResource, properties []vropsProperty) (keys []duplicateKey) {
+
+	for _, dp := range duplicateProperties {
+		if dp.recordType != recordType {
+			continue
+		}
+		for _, property := range properties {
+			if property.Name == dp.property && property.Value != "" {
+				keys = append(keys, duplicateKey{
+					match: dp.match,
+					key:   strings.Join([]string{recordType, dp.match, strings.ToLower(property.Value)}, "|"),
+				})
+			}
+		}
+	}
+
+	var vcID, moRef string
+	for _, identifier := range resource.ResourceKey.ResourceIdentifiers {
+		switch identifier.IdentifierType.Name {
+		case "VMEntityVCID":
+			vcID = identifier.Value
+		case "VMEntityObjectID":
+			moRef = identifier.Value
+		}
+	}
+	if vcID != "" && moRef != "" {
+		keys = append(keys, duplicateKey{
+			match: "moref",
+			key:   strings.Join([]string{recordType, "moref", strings.ToLower(vcID), moRef}, "|"),
+		})
+	}
+
+	return keys
+
+}
+
+// note a resource as collected, pending a commit, and if it already was, return where from, and what matched
+// a stale resource isn't noted, so the ghost of a migrated VM can't make its live copy the duplicate
+// safe to call without an index, when duplicates aren't being looked for
+func (idx *duplicateIndex) check(adapter vropsAdapterInstance, resource vropsResource, recordType string, properties []vropsProperty, stale bool) (original duplicateSource, match string, found bool) {
+
+	if idx == nil {
+		return duplicateSource{}, "", false
+	}
+
+	source := duplicateSource{AdapterID: adapter.ID, Identifier: resource.Identifier}
+	keys := duplicateKeys(recordType, resource, properties)
+
+	// within one adapter, resources are distinct however alike they are, e.g. copied VMs sharing a BIOS UUID
+	for _, k := range keys {
+		if seen, ok := idx.seen[k.key]; ok && seen.AdapterID != adapter.ID {
+			return seen, k.match, true
+		}
+	}
+
+	if stale {
+		return duplicateSource{}, "", false
+	}
+
+	for _, k := range keys {
+		if _, ok := idx.pending[k.key]; !ok {
+			idx.pending[k.key] = source
+		}
+	}
+
+	return duplicateSource{}, "", false
+
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pdxfixit/hostdb"
+	"github.com/stretchr/testify/assert"
+)
+
+// a virtual machine, as seen through a vCenter adapter
+func testDuplicateResource(identifier string, vcID string, moRef string) vropsResource {
+
+	return vropsResource{
+		ResourceKey: vropsResourceKey{
+			Name:            "vm01.pdxfixit.com",
+			AdapterKindKey:  "VMWARE",
+			ResourceKindKey: "VirtualMachine",
+			ResourceIdentifiers: []vropsResourceIdentifier{
+				{IdentifierType: vropsResourceIdentifierType{Name: "VMEntityVCID"}, Value: vcID},
+				{IdentifierType: vropsResourceIdentifierType{Name: "VMEntityObjectID"}, Value: moRef},
+			},
+		},
+		Identifier: identifier,
+	}
+
+}
+
+func TestDuplicateKeys(t *testing.T) {
+
+	properties := []vropsProperty{
+		{Name: "config|instanceUuid", Value: "5003A1B2-C3D4-E5F6-0718-293A4B5C6D7E"},
+		{Name: "config|uuid", Value: "4203a1b2-c3d4-e5f6-0718-293a4b5c6d7e"},
+		{Name: "summary|guest|hostName", Value: "vm01.pdxfixit.com"},
+	}
+
+	keys := duplicateKeys("vrops-vmware-virtualmachine", testDuplicateResource("vm-a", "6e5b1f4c-vc01", "vm-101"), properties)
+	assert.Equal(t, []duplicateKey{
+		{match: "instance_uuid", key: "vrops-vmware-virtualmachine|instance_uuid|5003a1b2-c3d4-e5f6-0718-293a4b5c6d7e"},
+		{match: "bios_uuid", key: "vrops-vmware-virtualmachine|bios_uuid|4203a1b2-c3d4-e5f6-0718-293a4b5c6d7e"},
+		{match: "moref", key: "vrops-vmware-virtualmachine|moref|6e5b1f4c-vc01|vm-101"},
+	}, keys, "uuids, and the moref within the vCenter")
+
+	assert.Empty(t, duplicateKeys("vrops-vmware-datastore", vropsResource{Identifier: "ds-a"}, properties), "nothing to go on")
+
+}
+
+func TestDuplicateIndex(t *testing.T) {
+
+	a := vropsAdapterInstance{ID: "adapter-a"}
+	b := vropsAdapterInstance{ID: "adapter-b"}
+	properties := []vropsProperty{{Name: "config|instanceUuid", Value: "5003a1b2-c3d4-e5f6-0718-293a4b5c6d7e"}}
+
+	// without an index, nothing is a duplicate
+	var none *duplicateIndex
+	_, _, found := none.check(a, testDuplicateResource("vm-a", "vc01", "vm-101"), "vrops-vmware-virtualmachine", properties, false)
+	assert.False(t, found, "no index")
+	none.commit()
+	none.discard()
+
+	index := newDuplicateIndex()
+
+	_, _, found = index.check(a, testDuplicateResource("vm-a", "vc01", "vm-101"), "vrops-vmware-virtualmachine", properties, false)
+	assert.False(t, found, "first sighting")
+
+	_, _, found = index.check(a, testDuplicateResource("vm-a", "vc01", "vm-101"), "vrops-vmware-virtualmachine", properties, false)
+	assert.False(t, found, "the same resource again isn't a duplicate of itself")
+
+	// a copy of the VM in the same vCenter, with the same BIOS UUID
+	_, _, found = index.check(a, testDuplicateResource("vm-copy", "vc01", "vm-102"), "vrops-vmware-virtualmachine", properties, false)
+	assert.False(t, found, "another resource through the same adapter isn't a duplicate")
+
+	index.commit()
+
+	// migrated to another vCenter
+	original, match, found := index.check(b, testDuplicateResource("vm-b", "vc02", "vm-202"), "vrops-vmware-virtualmachine", properties, false)
+	assert.True(t, found, "same instance uuid")
+	assert.Equal(t, duplicateSource{AdapterID: "adapter-a", Identifier: "vm-a"}, original, "first seen")
+	assert.Equal(t, "instance_uuid", match, "match")
+
+	// another vROps adapter for the same vCenter, without the uuid properties
+	original, match, found = index.check(b, testDuplicateResource("vm-c", "vc01", "vm-101"), "vrops-vmware-virtualmachine", nil, false)
+	assert.True(t, found, "same moref in the same vCenter")
+	assert.Equal(t, duplicateSource{AdapterID: "adapter-a", Identifier: "vm-a"}, original, "first seen")
+	assert.Equal(t, "moref", match, "match")
+
+	_, _, found = index.check(b, testDuplicateResource("vm-d", "vc02", "vm-101"), "vrops-vmware-virtualmachine", nil, false)
+	assert.False(t, found, "same moref in another vCenter")
+
+	// an adapter which won't be delivered doesn't count
+	c := vropsAdapterInstance{ID: "adapter-c"}
+	other := []vropsProperty{{Name: "config|instanceUuid", Value: "5003ffff-c3d4-e5f6-0718-293a4b5c6d7e"}}
+	index.commit()
+	_, _, found = index.check(c, testDuplicateResource("vm-e", "vc03", "vm-303"), "vrops-vmware-virtualmachine", other, false)
+	assert.False(t, found, "first sighting")
+	index.discard()
+	_, _, found = index.check(b, testDuplicateResource("vm-f", "vc02", "vm-203"), "vrops-vmware-virtualmachine", other, false)
+	assert.False(t, found, "discarded")
+
+}
+
+func TestGetResourcePropertiesDuplicates(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := fmt.Fprint(w, `{"resourceId":"vm","property":[{"name":"config|instanceUuid","value":"5003a1b2-c3d4-e5f6-0718-293a4b5c6d7e"}]}`); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	saved := config
+	defer func() { config = saved }()
+
+	config.Vrops.Host = ts.URL
+	config.Vrops.ResourceKindKeys = []string{"VirtualMachine"}
+
+	a := vropsAdapterInstance{ID: "adapter-a"}
+	b := vropsAdapterInstance{ID: "adapter-b"}
+
+	for _, policy := range []string{duplicatesMark, duplicatesDrop} {
+
+		config.Collector.Duplicates = policy
+		index := newDuplicateIndex()
+
+		first := getResourceProperties(context.Background(), a, 0, []vropsResource{testDuplicateResource("vm-a", "vc01", "vm-101")}, nil, index)
+		if assert.Len(t, first, 1, "first sighting") {
+			assert.NotContains(t, first[0].Context, "duplicate_of", "not marked")
+		}
+		index.commit()
+
+		report := newRunReport("test-run").adapter(b)
+		second := getResourceProperties(context.Background(), b, 0, []vropsResource{testDuplicateResource("vm-b", "vc02", "vm-202")}, report, index)
+
+		switch policy {
+		case duplicatesMark:
+			if assert.Len(t, second, 1, "kept") {
+				assert.Equal(t, duplicateSource{AdapterID: "adapter-a", Identifier: "vm-a"}, second[0].Context["duplicate_of"], "marked")
+				assert.Equal(t, "instance_uuid", second[0].Context["duplicate_match"], "match")
+			}
+		case duplicatesDrop:
+			assert.Empty(t, second, "dropped")
+		}
+
+		assert.Equal(t, []resourceDuplicate{{
+			Identifier:  "vm-b",
+			Kind:        "VirtualMachine",
+			Match:       "instance_uuid",
+			DuplicateOf: duplicateSource{AdapterID: "adapter-a", Identifier: "vm-a"},
+		}}, report.Duplicates, "reported")
+
+	}
+
+}
+
+func TestGetResourcePropertiesDuplicatesStale(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := fmt.Fprint(w, `{"resourceId":"vm","property":[{"name":"config|instanceUuid","value":"5003a1b2-c3d4-e5f6-0718-293a4b5c6d7e"}]}`); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	saved := config
+	defer func() { config = saved }()
+
+	config.Vrops.Host = ts.URL
+	config.Vrops.ResourceKindKeys = []string{"VirtualMachine"}
+	config.Collector.Duplicates = duplicatesDrop
+	config.Collector.Stale = staleConfig{Policy: staleFlag, States: []string{"NOT_EXISTING"}}
+
+	a := vropsAdapterInstance{ID: "adapter-a"}
+	b := vropsAdapterInstance{ID: "adapter-b"}
+
+	// migrated; the old vCenter's adapter still has the ghost, and it's collected first
+	ghost := testDuplicateResource("vm-a", "vc01", "vm-101")
+	ghost.ResourceStatusStates = []vropsResourceStatusState{{AdapterInstanceID: "adapter-a", ResourceStatus: "DATA_RECEIVING", ResourceState: "NOT_EXISTING"}}
+	live := testDuplicateResource("vm-b", "vc02", "vm-202")
+
+	for _, policy := range []string{staleFlag, staleSeparate, staleKeep} {
+		config.Collector.Stale.Policy = policy
+		index := newDuplicateIndex()
+		assert.Len(t, getResourceProperties(context.Background(), a, 0, []vropsResource{ghost}, nil, index), 1, "ghost kept, "+policy)
+		index.commit()
+		assert.Len(t, getResourceProperties(context.Background(), b, 0, []vropsResource{live}, nil, index), 1, "live copy kept, "+policy)
+	}
+
+	// the other way around, the ghost is the duplicate
+	config.Collector.Stale.Policy = staleFlag
+	index := newDuplicateIndex()
+	assert.Len(t, getResourceProperties(context.Background(), b, 0, []vropsResource{live}, nil, index), 1, "live copy kept")
+	index.commit()
+	assert.Empty(t, getResourceProperties(context.Background(), a, 0, []vropsResource{ghost}, nil, index), "ghost dropped")
+
+}
+
+func TestCollectAdaptersDuplicatesUnhealthy(t *testing.T) {
+
+	// adapter A lists one VM, but says it collects 100; adapter B has the same VM, through another vCenter
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		var response string
+		switch {
+		case r.URL.Path == "/suite-api/api/auth/token/acquire":
+			response = `{"token":"test-token","validity":1546127294284,"roles":[]}`
+		case r.URL.Path == "/suite-api/api/adapters":
+			response = fmt.Sprintf(`{"adapterInstancesInfoDto":[`+
+				`{"resourceKey":{"name":"Adapter A","adapterKindKey":"VMWARE","resourceKindKey":"VMwareAdapter Instance","resourceIdentifiers":[{"identifierType":{"name":"VCURL"},"value":"vc01.test.pdxfixit.com"}]},"numberOfResourcesCollected":100,"lastHeartbeat":%[1]d,"id":"adapter-a"},`+
+				`{"resourceKey":{"name":"Adapter B","adapterKindKey":"VMWARE","resourceKindKey":"VMwareAdapter Instance","resourceIdentifiers":[{"identifierType":{"name":"VCURL"},"value":"vc02.test.pdxfixit.com"}]},"numberOfResourcesCollected":1,"lastHeartbeat":%[1]d,"id":"adapter-b"}]}`,
+				time.Now().UnixNano()/int64(time.Millisecond))
+		case r.URL.Path == "/suite-api/api/adapters/adapter-a/resources":
+			response = `{"pageInfo":{"totalCount":1,"page":0,"pageSize":1000},"resourceList":[{"resourceKey":{"name":"vm01","adapterKindKey":"VMWARE","resourceKindKey":"VirtualMachine"},"identifier":"vm-a"}]}`
+		case r.URL.Path == "/suite-api/api/adapters/adapter-b/resources":
+			response = `{"pageInfo":{"totalCount":1,"page":0,"pageSize":1000},"resourceList":[{"resourceKey":{"name":"vm01","adapterKindKey":"VMWARE","resourceKindKey":"VirtualMachine"},"identifier":"vm-b"}]}`
+		case strings.HasSuffix(r.URL.Path, "/properties"):
+			response = `{"resourceId":"vm","property":[{"name":"config|instanceUuid","value":"5003a1b2-c3d4-e5f6-0718-293a4b5c6d7e"}]}`
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		if _, err := fmt.Fprint(w, response); err != nil {
+			t.Error(err)
+		}
+
+	}))
+	defer ts.Close()
+
+	saved := config
+	defer func() { config = saved }()
+	testCollectionConfig(ts.URL)
+	config.Vrops.ResourceKindKeys = []string{"VirtualMachine"}
+	config.Collector.Duplicates = duplicatesDrop
+	config.Health.MinResourceRatio = 0.5
+
+	buf := &bytes.Buffer{}
+	output = buf
+	defer func() { output = os.Stdout }()
+
+	// A is held back, so B's copy of the VM is the one delivered
+	err := collectAdapters(context.Background(), []sink{stdoutSink{}}, adapterSelected)
+	assert.Equal(t, exitCollection, exitCode(err), "adapter A is unhealthy")
+
+	var recordSet hostdb.RecordSet
+	if assert.NoError(t, json.Unmarshal(buf.Bytes(), &recordSet), "one recordset") {
+		assert.Equal(t, "vc02.test.pdxfixit.com", recordSet.Context["vc_url"], "adapter B")
+		if assert.Len(t, recordSet.Records, 1, "not dropped") {
+			assert.NotContains(t, recordSet.Records[0].Context, "duplicate_of", "not marked")
+		}
+	}
+
+}
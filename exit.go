@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+)
+
+// exit codes, so that whatever runs the collector can tell failures apart
+const (
+	exitOK         = 0
+	exitFailure    = 1 // anything not covered below
+	exitUsage      = 2 // bad command line
+	exitConfig     = 3 // the configuration couldn't be loaded, or isn't valid
+	exitAuth       = 4 // unable to log in to vROps
+	exitCollection = 5 // some or all of the adapters couldn't be collected
+	exitSend       = 6 // some or all of the records couldn't be delivered
+)
+
+// an error which should end the process with a particular exit code
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e exitError) Unwrap() error {
+	return e.err
+}
+
+// wrap an error with the exit code it should result in
+func withExitCode(code int, err error) error {
+
+	if err == nil {
+		return nil
+	}
+
+	return exitError{code: code, err: err}
+
+}
+
+// the exit code for an error
+func exitCode(err error) int {
+
+	if err == nil {
+		return exitOK
+	}
+
+	var e exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+
+	return exitFailure
+
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pdxfixit/hostdb"
+	"github.com/stretchr/testify/assert"
+)
+
+// a sink which never manages to write anything
+type failingSink struct{}
+
+func (s failingSink) Name() string {
+	return "failing"
+}
+
+func (s failingSink) Write(ctx context.Context, recordSet hostdb.RecordSet) error {
+	return errors.New("unable to write")
+}
+
+func TestExitCode(t *testing.T) {
+
+	assert.Equal(t, exitOK, exitCode(nil), "success")
+	assert.Equal(t, exitFailure, exitCode(errors.New("oops")), "anything else")
+	assert.Equal(t, exitAuth, exitCode(withExitCode(exitAuth, errors.New("401 Unauthorized"))), "wrapped")
+	assert.Equal(t, exitSend, exitCode(fmt.Errorf("run failed: %w", withExitCode(exitSend, errors.New("oops")))), "wrapped again")
+	assert.NoError(t, withExitCode(exitConfig, nil), "no error, no exit code")
+
+}
+
+func TestCommandExitCodes(t *testing.T) {
+
+	for name, cmd := range commands {
+		assert.Equal(t, exitUsage, exitCode(cmd.run(context.Background(), []string{"unexpected", "arguments"})), name)
+	}
+
+	saved := config.Hostdb.SpoolDir
+	defer func() { config.Hostdb.SpoolDir = saved }()
+	config.Hostdb.SpoolDir = ""
+	assert.Equal(t, exitConfig, exitCode(replay(context.Background(), nil)), "replay without a spool")
+
+}
+
+func testCollectionConfig(host string) {
+
+	config.Vrops.Host = host
+	config.Vrops.PageSize = 1000
+	config.Vrops.ResourceKindKeys = []string{"HostSystem"}
+	config.Collector.Include = nil
+	config.Collector.Exclude = nil
+	config.Collector.Report = ""
+	config.Collector.Stream = ""
+	config.Hostdb.SpoolDir = ""
+
+}
+
+func TestCollectAdaptersAuthFailure(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	saved := config
+	defer func() { config = saved }()
+	testCollectionConfig(ts.URL)
+
+	err := collectAdapters(context.Background(), []sink{stdoutSink{}}, adapterSelected)
+	assert.Equal(t, exitAuth, exitCode(err), "auth failure")
+
+}
+
+func TestCollectAdaptersCollectionFailure(t *testing.T) {
+
+	ts := testVropsServer(t)
+	defer ts.Close()
+
+	// the resources for the adapter can't be listed
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/resources") {
+			http.Error(w, "oops", http.StatusInternalServerError)
+			return
+		}
+		ts.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer failing.Close()
+
+	saved := config
+	defer func() { config = saved }()
+	testCollectionConfig(failing.URL)
+
+	buf := &bytes.Buffer{}
+	output = buf
+	defer func() { output = os.Stdout }()
+
+	err := collectAdapters(context.Background(), []sink{stdoutSink{}}, adapterSelected)
+	assert.Equal(t, exitCollection, exitCode(err), "collection failure")
+	assert.Contains(t, err.Error(), "Test Adapter", "names the adapter")
+	assert.Empty(t, buf.String(), "nothing delivered")
+
+}
+
+func TestCollectAdaptersSendFailure(t *testing.T) {
+
+	ts := testVropsServer(t)
+	defer ts.Close()
+
+	saved := config
+	defer func() { config = saved }()
+	testCollectionConfig(ts.URL)
+
+	buf := &bytes.Buffer{}
+	output = buf
+	defer func() { output = os.Stdout }()
+
+	// the other sinks are still written to, but the run fails
+	err := collectAdapters(context.Background(), []sink{failingSink{}, stdoutSink{}}, adapterSelected)
+	assert.Equal(t, exitSend, exitCode(err), "send failure")
+	assert.Contains(t, err.Error(), "Test Adapter", "names the adapter")
+	assert.Contains(t, buf.String(), "vrops-vmware-hostsystem", "delivered to stdout")
+
+}
+
+func TestCollectAdaptersSpooled(t *testing.T) {
+
+	ts := testVropsServer(t)
+	defer ts.Close()
+
+	// hostdb is down
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { assert.NoError(t, os.RemoveAll(dir)) }()
+
+	saved := config
+	defer func() { config = saved }()
+	testCollectionConfig(ts.URL)
+	config.Hostdb.URL = down.URL
+	config.Hostdb.SpoolDir = filepath.Join(dir, "spool")
+	config.Collector.Report = filepath.Join(dir, "report.json")
+
+	// spooled for later, but not delivered
+	err = collectAdapters(context.Background(), []sink{hostdbSink{}}, adapterSelected)
+	assert.Equal(t, exitSend, exitCode(err), "send failure")
+	assert.Contains(t, err.Error(), "Test Adapter", "names the adapter")
+
+	entries, err := spooledEntries()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1, "spooled")
+
+	data, err := ioutil.ReadFile(config.Collector.Report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report runReport
+	assert.NoError(t, json.Unmarshal(data, &report))
+	if assert.Len(t, report.Adapters, 1, "one adapter") {
+		assert.Equal(t, sendSpooled, report.Adapters[0].Sends["hostdb"], "reported as spooled")
+		assert.Equal(t, adapterFailed, report.Adapters[0].Status, "status")
+	}
+
+}
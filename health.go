@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// when an epoch timestamp in milliseconds from vROps was, or the zero time if it never was
+func vropsTime(ms int) time.Time {
+
+	if ms <= 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, int64(ms)*int64(time.Millisecond)).UTC()
+
+}
+
+// why an adapter can't be trusted to replace what's in hostdb, per the health section of config; empty when it's healthy
+// a broken adapter still answers, but with little or nothing, which would otherwise wipe out its vCenter in hostdb
+func adapterProblems(adapter vropsAdapterInstance, now time.Time) (problems []string) {
+
+	if config.Health.MaxHeartbeatAge > 0 {
+		heartbeat := vropsTime(adapter.LastHeartbeat)
+		switch {
+		case heartbeat.IsZero():
+			problems = append(problems, "no heartbeat")
+		case now.Sub(heartbeat) > config.Health.MaxHeartbeatAge:
+			problems = append(problems, fmt.Sprintf(
+				"last heartbeat %s ago, more than %s",
+				now.Sub(heartbeat).Truncate(time.Second),
+				config.Health.MaxHeartbeatAge,
+			))
+		}
+	}
+
+	if config.Health.Message != "" && !strings.Contains(strings.ToLower(adapter.MessageFromAdapterInstance), strings.ToLower(config.Health.Message)) {
+		problems = append(problems, fmt.Sprintf("message %q, not %q", adapter.MessageFromAdapterInstance, config.Health.Message))
+	}
+
+	if adapter.NumberOfResourcesCollected < config.Health.MinResources {
+		problems = append(problems, fmt.Sprintf(
+			"collecting %d resources, fewer than %d",
+			adapter.NumberOfResourcesCollected,
+			config.Health.MinResources,
+		))
+	}
+
+	return problems
+
+}
+
+// why what an adapter listed can't be trusted, once it's been collected; empty when it's healthy
+// an adapter can look healthy beforehand, but list far fewer resources than it says it collects
+func listingProblem(adapter vropsAdapterInstance, listed int) string {
+
+	if config.Health.MinResourceRatio <= 0 || adapter.NumberOfResourcesCollected <= 0 {
+		return ""
+	}
+
+	if float64(listed) < config.Health.MinResourceRatio*float64(adapter.NumberOfResourcesCollected) {
+		return fmt.Sprintf(
+			"listed %d resources, fewer than %g of the %d it collects",
+			listed,
+			config.Health.MinResourceRatio,
+			adapter.NumberOfResourcesCollected,
+		)
+	}
+
+	return ""
+
+}
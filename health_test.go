@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVropsTime(t *testing.T) {
+
+	assert.True(t, vropsTime(0).IsZero(), "never")
+	assert.Equal(t, time.Date(2019, 1, 8, 1, 8, 15, 138000000, time.UTC), vropsTime(1546909695138), "milliseconds since the epoch")
+
+}
+
+func TestAdapterProblems(t *testing.T) {
+
+	saved := config
+	defer func() { config = saved }()
+
+	now := time.Date(2019, 1, 8, 1, 10, 0, 0, time.UTC)
+	adapter := vropsAdapterInstance{
+		NumberOfResourcesCollected: 55,
+		LastHeartbeat:              1546909695138, // 01:08:15
+		MessageFromAdapterInstance: "Trust Established.",
+	}
+
+	config.Health = healthConfig{}
+	assert.Empty(t, adapterProblems(vropsAdapterInstance{}, now), "nothing checked")
+
+	config.Health = healthConfig{MaxHeartbeatAge: 5 * time.Minute, Message: "trust established", MinResources: 1}
+	assert.Empty(t, adapterProblems(adapter, now), "healthy")
+
+	assert.Equal(t, []string{
+		"last heartbeat 1h1m44s ago, more than 5m0s",
+		"message \"Unable to connect to vcenter.pdxfixit.com\", not \"trust established\"",
+		"collecting 0 resources, fewer than 1",
+	}, adapterProblems(vropsAdapterInstance{
+		LastHeartbeat:              1546909695138,
+		MessageFromAdapterInstance: "Unable to connect to vcenter.pdxfixit.com",
+	}, now.Add(time.Hour)), "every problem")
+
+	assert.Equal(t, []string{"no heartbeat"}, adapterProblems(vropsAdapterInstance{
+		NumberOfResourcesCollected: 55,
+		MessageFromAdapterInstance: "Trust Established.",
+	}, now), "never a heartbeat")
+
+}
+
+func TestListingProblem(t *testing.T) {
+
+	saved := config
+	defer func() { config = saved }()
+
+	adapter := vropsAdapterInstance{NumberOfResourcesCollected: 1000}
+
+	config.Health.MinResourceRatio = 0
+	assert.Empty(t, listingProblem(adapter, 0), "not checked")
+
+	config.Health.MinResourceRatio = 0.5
+	assert.Empty(t, listingProblem(adapter, 500), "enough")
+	assert.Empty(t, listingProblem(vropsAdapterInstance{}, 0), "nothing to compare against")
+	assert.Equal(t, "listed 12 resources, fewer than 0.5 of the 1000 it collects", listingProblem(adapter, 12), "near-empty")
+
+}
+
+func TestCollectAdaptersUnhealthy(t *testing.T) {
+
+	ts := testVropsServer(t)
+	defer ts.Close()
+
+	saved := config
+	defer func() { config = saved }()
+	testCollectionConfig(ts.URL)
+
+	// the test adapter only collects one resource
+	config.Health.MinResources = 100
+
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { assert.NoError(t, os.RemoveAll(dir)) }()
+	config.Collector.Report = filepath.Join(dir, "report.json")
+
+	buf := &bytes.Buffer{}
+	output = buf
+	defer func() { output = os.Stdout }()
+
+	err = collectAdapters(context.Background(), []sink{stdoutSink{}}, adapterSelected)
+	assert.Equal(t, exitCollection, exitCode(err), "the run fails")
+	assert.Contains(t, err.Error(), "Test Adapter", "names the adapter")
+	assert.Empty(t, buf.String(), "nothing delivered")
+
+	data, err := ioutil.ReadFile(config.Collector.Report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report runReport
+	assert.NoError(t, json.Unmarshal(data, &report))
+	if assert.Len(t, report.Adapters, 1, "one adapter") {
+		assert.Equal(t, adapterUnhealthy, report.Adapters[0].Status, "status")
+		assert.Equal(t, "collecting 1 resources, fewer than 100", report.Adapters[0].Reason, "why")
+	}
+
+}
+
+func TestCollectAdaptersListedTooFew(t *testing.T) {
+
+	ts := testVropsServer(t)
+	defer ts.Close()
+
+	// the adapter says it collects 100 resources, but only one is listed
+	few := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		ts.Config.Handler.ServeHTTP(rec, r)
+		if _, err := w.Write(bytes.Replace(rec.Body.Bytes(), []byte(`"numberOfResourcesCollected":1,`), []byte(`"numberOfResourcesCollected":100,`), 1)); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer few.Close()
+
+	saved := config
+	defer func() { config = saved }()
+	testCollectionConfig(few.URL)
+	config.Health.MinResourceRatio = 0.5
+
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { assert.NoError(t, os.RemoveAll(dir)) }()
+	config.Collector.Report = filepath.Join(dir, "report.json")
+
+	buf := &bytes.Buffer{}
+	output = buf
+	defer func() { output = os.Stdout }()
+
+	err = collectAdapters(context.Background(), []sink{stdoutSink{}}, adapterSelected)
+	assert.Equal(t, exitCollection, exitCode(err), "the run fails")
+	assert.Empty(t, buf.String(), "nothing delivered")
+
+	data, err := ioutil.ReadFile(config.Collector.Report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report runReport
+	assert.NoError(t, json.Unmarshal(data, &report))
+	if assert.Len(t, report.Adapters, 1, "one adapter") {
+		assert.Equal(t, adapterUnhealthy, report.Adapters[0].Status, "status")
+		assert.Equal(t, "listed 1 resources, fewer than 0.5 of the 100 it collects", report.Adapters[0].Reason, "why")
+		assert.Equal(t, 1, report.Adapters[0].Records, "collected, but not sent")
+	}
+
+}
@@ -1,26 +1,51 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"strings"
 	"time"
 
 	"github.com/pdxfixit/hostdb"
 )
 
+// the context keys set by the collector, which static context from config can't replace
+var recordSetContextKeys = []string{
+	"collector_group_id",
+	"collector_id",
+	"collected",
+	"collector_version",
+	"last_collected",
+	"metrics_collected",
+	"monitoring_interval",
+	"resources_collected",
+	"run_id",
+	"vc_desc",
+	"vc_name",
+	"vc_url",
+	"vrops_host",
+}
+
 func createRecordSet(adapter vropsAdapterInstance, records []hostdb.Record) (recordSet hostdb.RecordSet) {
 
-	// context
-	context := map[string]interface{}{
-		"vc_name": adapter.ResourceKey.Name,
+	// context, starting with anything static from config, e.g. site, region or environment
+	context := map[string]interface{}{}
+	for k, v := range config.Collector.Context {
+		context[k] = v
 	}
 
+	context["vc_name"] = adapter.ResourceKey.Name
+
 	// attempt to get a vCenter URL
-	for _, identifier := range adapter.ResourceKey.ResourceIdentifiers {
-		if identifier.IdentifierType.Name == "VCURL" {
-			context["vc_url"] = identifier.Value
-			break
-		}
+	if vcURL := adapter.VcURL(); vcURL != "" {
+		context["vc_url"] = vcURL
 	}
 
 	// if there's a description
@@ -28,12 +53,40 @@ func createRecordSet(adapter vropsAdapterInstance, records []hostdb.Record) (rec
 		context["vc_desc"] = adapter.Description
 	}
 
+	// tie together every recordset from the same run
+	if runID != "" {
+		context["run_id"] = runID
+	}
+
+	// what vROps knows about the adapter
+	context["collector_id"] = adapter.CollectorID
+	if adapter.CollectorGroupID != "" {
+		context["collector_group_id"] = adapter.CollectorGroupID
+	}
+	context["monitoring_interval"] = adapter.MonitoringInterval
+	lastCollected := vropsTime(adapter.LastCollected)
+	if !lastCollected.IsZero() {
+		context["last_collected"] = lastCollected.Format(time.RFC3339)
+	}
+	context["resources_collected"] = adapter.NumberOfResourcesCollected
+	context["metrics_collected"] = adapter.NumberOfMetricsCollected
+
+	// and where it came from
+	if host := vropsHost(); host != "" {
+		context["vrops_host"] = host
+	}
+	context["collector_version"] = version
+
+	// when the collector collected it; when vROps did is last_collected
+	collected := time.Now().UTC()
+	context["collected"] = collected.Format(time.RFC3339)
+
 	recordSet = hostdb.RecordSet{
 		Type: strings.ToLower(fmt.Sprintf(
 			"vrops-%s",
 			strings.Replace(adapter.ResourceKey.AdapterKindKey, " ", "_", -1),
 		)), // e.g. vrops-vmware
-		Timestamp: time.Now().UTC().Format("2006-01-02 15:04:05"),
+		Timestamp: primaryTimestamp(collected, lastCollected),
 		Context:   context,
 		Committer: "hostdb-collector-vrops",
 		Records:   records,
@@ -42,3 +95,199 @@ func createRecordSet(adapter vropsAdapterInstance, records []hostdb.Record) (rec
 	return recordSet
 
 }
+
+// what fills the timestamp of records and recordsets
+const (
+	timestampCollected = "collected"
+	timestampVrops     = "vrops"
+)
+
+// the primary timestamp, in RFC 3339: when the collector collected it, or, if configured, when vROps did, if vROps says
+func primaryTimestamp(collected time.Time, vrops time.Time) string {
+
+	if config.Collector.Timestamp == timestampVrops && !vrops.IsZero() {
+		return vrops.UTC().Format(time.RFC3339)
+	}
+
+	return collected.UTC().Format(time.RFC3339)
+
+}
+
+// where record ids come from
+const (
+	recordIDIdentifier = "identifier"
+	recordIDUUID       = "uuid"
+)
+
+// properties holding a uuid which vSphere keeps for the life of the machine
+var uuidProperties = map[string]string{
+	"vrops-vmware-hostsystem":     "hardware|systemInfo|uuid",
+	"vrops-vmware-virtualmachine": "config|instanceUuid",
+}
+
+// a stable id for a record, so that hostdb can follow the same resource from run to run, renames included
+// it's the vROps resource identifier, or the vSphere uuid when configured and present, hashed along with the record type
+func recordID(recordType string, identifier string, properties []vropsProperty) string {
+
+	key := identifier
+	if name, ok := uuidProperties[recordType]; ok && config.Collector.RecordID == recordIDUUID {
+		for _, property := range properties {
+			if property.Name == name && property.Value != "" {
+				key = strings.ToLower(property.Value)
+				break
+			}
+		}
+	}
+
+	sum := sha1.Sum([]byte(recordType + "/" + key))
+
+	return hex.EncodeToString(sum[:])
+
+}
+
+// a random identifier for a collection run
+func newRunID() string {
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(b)
+
+}
+
+// split a recordset into chunks of no more than maxRecords records, and roughly no more than maxBytes bytes
+// each chunk carries the run ID, its sequence number, and the total number of chunks in its context
+func chunkRecordSet(recordSet hostdb.RecordSet, maxRecords int, maxBytes int) (chunks []hostdb.RecordSet, err error) {
+
+	// chunking is disabled
+	if maxRecords < 1 && maxBytes < 1 {
+		return []hostdb.RecordSet{recordSet}, nil
+	}
+
+	var groups [][]hostdb.Record
+	var current []hostdb.Record
+	size := 0
+
+	for _, record := range recordSet.Records {
+
+		data, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+
+		full := (maxRecords > 0 && len(current) >= maxRecords) ||
+			(maxBytes > 0 && size+len(data) > maxBytes)
+
+		// always put at least one record in a chunk, however large
+		if full && len(current) > 0 {
+			groups = append(groups, current)
+			current = nil
+			size = 0
+		}
+
+		current = append(current, record)
+		size += len(data) + 1 // plus a comma
+
+	}
+
+	// the last (or only) chunk, which might be empty if there were no records
+	groups = append(groups, current)
+
+	for i, records := range groups {
+
+		context := map[string]interface{}{}
+		for k, v := range recordSet.Context {
+			context[k] = v
+		}
+		context["chunk"] = i + 1
+		context["chunks"] = len(groups)
+
+		chunks = append(chunks, hostdb.RecordSet{
+			Type:      recordSet.Type,
+			Timestamp: recordSet.Timestamp,
+			Context:   context,
+			Committer: recordSet.Committer,
+			Records:   records,
+		})
+
+	}
+
+	return chunks, nil
+
+}
+
+// post a recordset to hostdb
+// with hostdb.url configured the request is made here, optionally gzipped; otherwise it's left to the hostdb package
+func sendRecordSet(ctx context.Context, recordSet hostdb.RecordSet, params string) (err error) {
+
+	if config.Hostdb.URL == "" {
+		return recordSet.Send(params)
+	}
+
+	data, err := json.Marshal(recordSet)
+	if err != nil {
+		return err
+	}
+
+	header := map[string]string{
+		"Accept":       "application/json",
+		"Content-Type": "application/json",
+	}
+
+	if config.Hostdb.User != "" {
+		pass, err := hostdbPass(ctx)
+		if err != nil {
+			return err
+		}
+		header["Authorization"] = fmt.Sprintf(
+			"Basic %s",
+			base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", config.Hostdb.User, pass))),
+		)
+	}
+
+	if config.Hostdb.Gzip {
+		header["Content-Encoding"] = "gzip"
+	}
+
+	url := config.Hostdb.URL
+	if params != "" {
+		url = fmt.Sprintf("%s?%s", url, params)
+	}
+
+	if response, err := httpRequest(ctx, "POST", url, bytes.NewReader(data), header); err != nil {
+		return fmt.Errorf("%v: %s", err, response)
+	}
+
+	return nil
+
+}
+
+// read a recordset from a json file
+func readRecordSetFile(path string) (recordSet hostdb.RecordSet, err error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return hostdb.RecordSet{}, err
+	}
+
+	if err := json.Unmarshal(data, &recordSet); err != nil {
+		return hostdb.RecordSet{}, err
+	}
+
+	return recordSet, nil
+
+}
+
+// write a recordset to a json file
+func writeRecordSetFile(path string, recordSet hostdb.RecordSet) (err error) {
+
+	data, err := json.Marshal(recordSet)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+
+}
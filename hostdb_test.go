@@ -1,9 +1,15 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/pdxfixit/hostdb"
 	"github.com/stretchr/testify/assert"
@@ -76,9 +82,31 @@ func TestCreateRecordSet(t *testing.T) {
 		},
 	}
 
+	runID = "test-run"
+	defer func() { runID = "" }()
+
+	saved := config
+	defer func() { config = saved }()
+	config.Vrops.Host = "https://vrops.test.pdxfixit.com"
+	config.Collector.Context = map[string]string{"site": "pdx", "environment": "test"}
+
+	adapter.LastCollected = 1546909506780
+
 	recordSet := createRecordSet(adapter, records)
 
 	assert.Equal(t, recordSet.Context["vc_name"], adapter.ResourceKey.Name, "vc_name")
+	assert.Equal(t, recordSet.Context["run_id"], "test-run", "run_id")
+	assert.Equal(t, 1, recordSet.Context["collector_id"], "collector_id")
+	assert.Equal(t, "foo", recordSet.Context["collector_group_id"], "collector_group_id")
+	assert.Equal(t, 2, recordSet.Context["monitoring_interval"], "monitoring_interval")
+	assert.Equal(t, "2019-01-08T01:05:06Z", recordSet.Context["last_collected"], "last_collected")
+	assert.Equal(t, 4, recordSet.Context["resources_collected"], "resources_collected")
+	assert.Equal(t, 3, recordSet.Context["metrics_collected"], "metrics_collected")
+	assert.Equal(t, "vrops.test.pdxfixit.com", recordSet.Context["vrops_host"], "vrops_host")
+	assert.Equal(t, version, recordSet.Context["collector_version"], "collector_version")
+	assert.Equal(t, recordSet.Context["collected"], recordSet.Timestamp, "timestamp, from when it was collected")
+	assert.Equal(t, "pdx", recordSet.Context["site"], "static context")
+	assert.Equal(t, "test", recordSet.Context["environment"], "static context")
 
 	for _, identifier := range adapter.ResourceKey.ResourceIdentifiers {
 		if identifier.IdentifierType.Name == "VCURL" {
@@ -98,3 +126,160 @@ func TestCreateRecordSet(t *testing.T) {
 	assert.NotEmpty(t, recordSet.Records, "records")
 
 }
+
+func TestPrimaryTimestamp(t *testing.T) {
+
+	saved := config
+	defer func() { config = saved }()
+
+	collected := time.Date(2019, 1, 8, 1, 10, 0, 0, time.FixedZone("PST", -8*60*60))
+	vrops := time.Date(2019, 1, 8, 1, 5, 6, 0, time.UTC)
+
+	config.Collector.Timestamp = timestampCollected
+	assert.Equal(t, "2019-01-08T09:10:00Z", primaryTimestamp(collected, vrops), "collected, in UTC")
+
+	config.Collector.Timestamp = timestampVrops
+	assert.Equal(t, "2019-01-08T01:05:06Z", primaryTimestamp(collected, vrops), "from vROps")
+	assert.Equal(t, "2019-01-08T09:10:00Z", primaryTimestamp(collected, time.Time{}), "vROps doesn't know")
+
+}
+
+func TestNewRunID(t *testing.T) {
+
+	a := newRunID()
+	b := newRunID()
+
+	assert.Len(t, a, 32, "run id length")
+	assert.NotEqual(t, a, b, "run ids are unique")
+
+}
+
+func TestRecordID(t *testing.T) {
+
+	saved := config
+	defer func() { config = saved }()
+
+	properties := []vropsProperty{{Name: "config|instanceUuid", Value: "5003A1B2-C3D4-E5F6-0718-293A4B5C6D7E"}}
+
+	config.Collector.RecordID = recordIDIdentifier
+	id := recordID("vrops-vmware-virtualmachine", "01afa5ae-216f-4b27-91a7-43abfe5d5905", properties)
+	assert.Len(t, id, 40, "a sha1")
+	assert.Equal(t, id, recordID("vrops-vmware-virtualmachine", "01afa5ae-216f-4b27-91a7-43abfe5d5905", nil), "stable, whatever the properties")
+	assert.NotEqual(t, id, recordID("vrops-vmware-hostsystem", "01afa5ae-216f-4b27-91a7-43abfe5d5905", nil), "scoped to the record type")
+
+	// the same machine, seen through another vROps
+	config.Collector.RecordID = recordIDUUID
+	id = recordID("vrops-vmware-virtualmachine", "01afa5ae-216f-4b27-91a7-43abfe5d5905", properties)
+	assert.Equal(t, id, recordID("vrops-vmware-virtualmachine", "7c1d0b52-0d6b-4a8c-9a57-5a0e4e8f1c11", properties), "from the uuid")
+	assert.Equal(t, id, recordID("vrops-vmware-virtualmachine", "7c1d0b52-0d6b-4a8c-9a57-5a0e4e8f1c11", []vropsProperty{{Name: "config|instanceUuid", Value: "5003a1b2-c3d4-e5f6-0718-293a4b5c6d7e"}}), "case-insensitively")
+
+	without := recordID("vrops-vmware-virtualmachine", "01afa5ae-216f-4b27-91a7-43abfe5d5905", nil)
+	config.Collector.RecordID = recordIDIdentifier
+	assert.Equal(t, recordID("vrops-vmware-virtualmachine", "01afa5ae-216f-4b27-91a7-43abfe5d5905", nil), without, "without a uuid, the identifier")
+
+}
+
+func TestChunkRecordSet(t *testing.T) {
+
+	recordSet := hostdb.RecordSet{
+		Type:      "vrops-vmware",
+		Timestamp: "2019-01-01 00:00:00",
+		Context:   map[string]interface{}{"vc_url": "vcenter.test.pdxfixit.com", "run_id": "abc123"},
+		Committer: "golang tests",
+	}
+	for i := 0; i < 10; i++ {
+		recordSet.Records = append(recordSet.Records, hostdb.Record{
+			ID:   fmt.Sprintf("%d", i),
+			Type: "test",
+			Data: []byte("{\"test\":\"0123456789\"}"),
+		})
+	}
+
+	// disabled
+	chunks, err := chunkRecordSet(recordSet, 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, chunks, 1, "no chunking")
+	assert.Nil(t, chunks[0].Context["chunk"], "no chunk context")
+
+	// by count
+	chunks, err = chunkRecordSet(recordSet, 4, 0)
+	assert.NoError(t, err)
+	assert.Len(t, chunks, 3, "chunks by count")
+	assert.Len(t, chunks[0].Records, 4, "first chunk")
+	assert.Len(t, chunks[2].Records, 2, "last chunk")
+	for i, chunk := range chunks {
+		assert.Equal(t, i+1, chunk.Context["chunk"], "chunk sequence")
+		assert.Equal(t, 3, chunk.Context["chunks"], "chunk count")
+		assert.Equal(t, "abc123", chunk.Context["run_id"], "shared run id")
+		assert.Equal(t, recordSet.Type, chunk.Type, "type")
+		assert.Equal(t, recordSet.Timestamp, chunk.Timestamp, "timestamp")
+	}
+	assert.Nil(t, recordSet.Context["chunk"], "original context untouched")
+
+	// by size
+	size, err := json.Marshal(recordSet.Records[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, err = chunkRecordSet(recordSet, 0, 3*(len(size)+1))
+	assert.NoError(t, err)
+	assert.Len(t, chunks, 4, "chunks by size")
+	assert.Len(t, chunks[0].Records, 3, "records per chunk by size")
+
+	// a single record larger than the limit still gets sent
+	chunks, err = chunkRecordSet(recordSet, 0, 1)
+	assert.NoError(t, err)
+	assert.Len(t, chunks, 10, "one record per chunk")
+
+	// no records at all
+	chunks, err = chunkRecordSet(hostdb.RecordSet{Context: map[string]interface{}{}}, 4, 0)
+	assert.NoError(t, err)
+	assert.Len(t, chunks, 1, "empty recordset")
+	assert.Empty(t, chunks[0].Records, "no records")
+
+}
+
+func TestSendRecordSet(t *testing.T) {
+
+	saved := config.Hostdb
+	defer func() { config.Hostdb = saved }()
+
+	var received hostdb.RecordSet
+
+	// setup fake http server for test
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		user, pass, ok := r.BasicAuth()
+		assert.True(t, ok, "basic auth")
+		assert.Equal(t, "hostdb-user", user, "user")
+		assert.Equal(t, "hostdb-pass", pass, "pass")
+		assert.Equal(t, "vcenter.test.pdxfixit.com", r.URL.Query().Get("vc_url"), "params")
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"), "content-encoding")
+
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.NewDecoder(zr).Decode(&received); err != nil {
+			t.Error(err.Error())
+		}
+
+	}))
+	defer ts.Close()
+
+	config.Hostdb.URL = ts.URL
+	config.Hostdb.User = "hostdb-user"
+	config.Hostdb.Pass = "hostdb-pass"
+	config.Hostdb.Gzip = true
+
+	recordSet := hostdb.RecordSet{
+		Type:    "vrops-vmware",
+		Context: map[string]interface{}{"vc_url": "vcenter.test.pdxfixit.com"},
+		Records: []hostdb.Record{{Type: "test", Data: []byte("{}")}},
+	}
+
+	assert.NoError(t, sendRecordSet(context.Background(), recordSet, "vc_url=vcenter.test.pdxfixit.com"))
+	assert.Equal(t, "vrops-vmware", received.Type, "type")
+	assert.Len(t, received.Records, 1, "records")
+
+}
@@ -1,16 +1,32 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pdxfixit/hostdb"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 )
 
+// the collector's version, set at build time
+var version = "dev"
+
+// identifies the current collection run
+var runID string
+
 var vropsSessionHeaders = map[string]string{
 	"Accept":       "application/json",
 	"Content-Type": "application/json",
@@ -18,38 +34,168 @@ var vropsSessionHeaders = map[string]string{
 
 func main() {
 
+	name, args := parseCommand(os.Args[1:])
+
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	// parse the flags for the command
+	flags := newFlagSet(name)
+	if err := flags.Parse(args); err != nil {
+		if err == pflag.ErrHelp {
+			os.Exit(exitOK)
+		}
+		os.Exit(exitUsage)
+	}
+
+	if err := bindFlags(flags); err != nil {
+		log.Fatal(err)
+	}
+
 	// load config
-	loadConfig()
+	if err := loadConfig(); err != nil {
+		log.Error(err)
+		os.Exit(exitConfig)
+	}
+
+	// cancel whatever's in flight on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := cmd.run(ctx, flags.Args()); err != nil {
+		log.Error(err)
+		os.Exit(exitCode(err))
+	}
+
+}
+
+// collect from each of the vcenter adapters, and send the results to hostdb
+func collect(ctx context.Context, args []string) (err error) {
+
+	if len(args) > 0 {
+		return withExitCode(exitUsage, fmt.Errorf("unexpected arguments: %v", args))
+	}
+
+	if err := checkConfig(); err != nil {
+		return err
+	}
+
+	sinks, err := configuredSinks()
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+
+	err = collectAdapters(ctx, sinks, adapterSelected)
+
+	// a one-shot run won't be around to be scraped, so push instead
+	if config.Metrics.Pushgateway != "" {
+		if pushErr := pushMetrics(err == nil); pushErr != nil {
+			log.WithError(pushErr).Warn("Unable to push metrics.")
+		}
+	}
+
+	return err
+
+}
+
+// collect from each of the selected vcenter adapters, delivering the results to the sinks
+func collectAdapters(ctx context.Context, sinks []sink, selected func(vropsAdapterInstance) bool) (err error) {
+
+	runID = newRunID()
+	setLogField("run_id", runID)
+	defer removeLogField("run_id")
+	log.Infof("Starting run %s...", runID)
+
+	report := newRunReport(runID)
+	defer func() {
+		runDuration.Set(time.Since(report.Started).Seconds())
+		if err == nil {
+			lastSuccess.SetToCurrentTime()
+		}
+
+		// summarise the run, for people and for monitoring
+		report.finish(err)
+		report.log()
+		if config.Collector.Report != "" {
+			if writeErr := report.write(config.Collector.Report); writeErr != nil {
+				log.WithError(writeErr).Warn("Unable to write the run report.")
+			}
+		}
+	}()
+
+	// give up on the whole run after a while
+	if config.Collector.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Collector.RunTimeout)
+		defer cancel()
+	}
+
+	// retry anything left over from previous runs first
+	if config.Hostdb.SpoolDir != "" {
+		sent, failed, err := replaySpool(ctx)
+		if err != nil {
+			log.WithError(err).Warn("Unable to replay the spool.")
+		} else if sent+failed > 0 {
+			log.Infof("Replayed %d recordsets from the spool, %d failed.", sent, failed)
+		}
+	}
+
+	// in streaming mode, records are written out as they're collected instead
+	var streamOutput io.WriteCloser
+	if config.Collector.Stream != "" {
+		if streamOutput, err = openStreamOutput(config.Collector.Stream); err != nil {
+			return withExitCode(exitSend, err)
+		}
+		defer func() {
+			if closeErr := streamOutput.Close(); closeErr != nil && err == nil {
+				err = withExitCode(exitSend, closeErr)
+			}
+		}()
+	}
+
+	// look out for the same machine turning up through more than one adapter
+	var duplicates *duplicateIndex
+	if config.Collector.Duplicates != "" && config.Collector.Duplicates != duplicatesOff {
+		duplicates = newDuplicateIndex()
+	}
 
 	// get a session token
-	vropsSessionHeaders["Authorization"] = fmt.Sprintf(
-		"vRealizeOpsToken %s",
-		getSessionToken(),
-	)
+	if err := login(ctx); err != nil {
+		return err
+	}
 
-	log.Println(fmt.Sprintf(
+	log.Infof(
 		"Getting a list of vCenters from %s...",
 		config.Vrops.Host,
-	))
+	)
 
 	vropsAdapterList := vropsAdapterList{}
 
 	// collect a list of vcenter instances from vrops
 	if err := vropsAdapterList.LoadFrom(
+		ctx,
 		fmt.Sprintf(
 			"%s/suite-api/api/adapters?compression=enabled",
 			config.Vrops.Host,
 		),
 	); err != nil {
-		log.Fatal(err)
+		return withExitCode(exitCollection, err)
 	}
 
-	log.Println(fmt.Sprintf(
+	log.Infof(
 		"Found %d adapter instances. Not all of these are vcenters.",
 		len(vropsAdapterList.Instances),
-	))
+	)
+
+	// adapters which failed; the others are still collected, but the run fails at the end
+	var uncollected, undelivered []string
 
 	// for each of the adapter instances
+	defer removeLogField("adapter")
+	defer removeLogField("adapter_id")
 	for n, adapter := range vropsAdapterList.Instances {
 
 		// if it's not a vcenter, move on to the next
@@ -57,31 +203,102 @@ func main() {
 			continue
 		}
 
-		log.Println(fmt.Sprintf(
+		// tag everything logged from here on with the adapter
+		setLogField("adapter", adapter.ResourceKey.Name)
+		setLogField("adapter_id", adapter.ID)
+
+		// if we're shutting down, don't start on another
+		if atomic.LoadInt32(&shutdown) != shutdownNone {
+			log.Info("Shutting down, skipping the remaining adapters.")
+			break
+		}
+
+		// if we've been interrupted or run out of time, don't start on another
+		if ctx.Err() != nil {
+			log.WithError(ctx.Err()).Info("Cancelled, skipping the remaining adapters.")
+			break
+		}
+
+		summary := report.adapter(adapter)
+
+		// if it's been filtered out, move on to the next
+		if !selected(adapter) {
+			log.Infof(
+				"Adapter %d/%d (%s) is not selected, skipping.",
+				n+1,
+				len(vropsAdapterList.Instances),
+				adapter.ResourceKey.Name,
+			)
+			summary.skip("not selected")
+			continue
+		}
+
+		// don't let a broken adapter's data replace what's in hostdb
+		if problems := adapterProblems(adapter, time.Now()); len(problems) > 0 {
+			log.Warnf(
+				"Adapter %d/%d (%s) is unhealthy, skipping: %s.",
+				n+1,
+				len(vropsAdapterList.Instances),
+				adapter.ResourceKey.Name,
+				strings.Join(problems, "; "),
+			)
+			summary.unhealthy(strings.Join(problems, "; "))
+			uncollected = append(uncollected, adapter.ResourceKey.Name)
+			continue
+		}
+
+		log.Infof(
 			"Adapter %d/%d (%s)...",
 			n+1,
 			len(vropsAdapterList.Instances),
 			adapter.ResourceKey.Name,
-		))
-		if config.Collector.Debug {
-			log.Println(fmt.Sprintf("%v", adapter))
-		}
+		)
+		transferred.Reset()
+		log.Debugf("%v", adapter)
 
-		vropsAdapterResources, err := getAdapterResources(adapter.ID, 0)
+		vropsAdapterResources, err := getAdapterResources(ctx, adapter.ID, 0)
 		if err != nil {
-			log.Println(err)
+			log.WithError(err).Error("Unable to get the resources for the adapter.")
+			summary.fail(fmt.Sprintf("unable to get the resources: %s", err))
+			summary.finish()
+			uncollected = append(uncollected, adapter.ResourceKey.Name)
 			continue
 		}
 
 		// check the number of resources
-		log.Println(fmt.Sprintf(
+		listed := len(vropsAdapterResources.ResourceList)
+		log.Infof(
 			"Found %d resources for the adapter %s. Only the ResourceKindKeys listed in config will be collected.",
 			vropsAdapterResources.PageInfo.TotalCount,
 			adapter.ID,
-		))
+		)
+
+		// either keep the records for a recordset, or stream them straight out
+		var records []hostdb.Record
+		var stream *recordStream
+		if streamOutput != nil {
+			if stream, err = newRecordStream(streamOutput, createRecordSet(adapter, nil)); err != nil {
+				return withExitCode(exitSend, err)
+			}
+		}
+		kinds := map[string]int{}
+		collected := func(page []hostdb.Record) error {
+			for _, record := range page {
+				kind, _ := record.Context["resource_kind"].(string)
+				kinds[kind]++
+			}
+			summary.Records += len(page)
+			if stream == nil {
+				records = append(records, page...)
+				return nil
+			}
+			return stream.Write(page)
+		}
 
 		// collect the first page of resources
-		records := getResourceProperties(vropsAdapterResources.ResourceList)
+		if err := collected(getResourceProperties(ctx, adapter, 0, vropsAdapterResources.ResourceList, summary, duplicates)); err != nil {
+			return withExitCode(exitSend, err)
+		}
 
 		// figure out how many iterations we need total
 		iterations := vropsAdapterResources.PageInfo.TotalCount / config.Vrops.PageSize
@@ -90,92 +307,247 @@ func main() {
 		}
 
 		// if >1k resources then we gotta navigate some pagination
+		abandoned := false
+		incomplete := false
 		for i := 1; i < iterations; i++ {
 
-			log.Println(fmt.Sprintf(
+			// when abandoning or cancelled, stop collecting and don't deliver a partial recordset
+			if atomic.LoadInt32(&shutdown) == shutdownAbandon || ctx.Err() != nil {
+				abandoned = true
+				break
+			}
+
+			log.Infof(
 				"Iteration %d/%d...",
 				i+1,
 				iterations,
-			))
+			)
 
-			resources, err := getAdapterResources(adapter.ID, i)
+			resources, err := getAdapterResources(ctx, adapter.ID, i)
 			if err != nil {
-				log.Println(err)
+				log.WithError(err).Errorf("Unable to get page %d of the resources for the adapter.", i+1)
+				summary.Errors = append(summary.Errors, fmt.Sprintf("unable to get page %d: %s", i+1, err))
+				incomplete = true
 				continue
 			}
 
 			// collect the resources
-			records = append(records, getResourceProperties(resources.ResourceList)...)
+			listed += len(resources.ResourceList)
+			if err := collected(getResourceProperties(ctx, adapter, i, resources.ResourceList, summary, duplicates)); err != nil {
+				return withExitCode(exitSend, err)
+			}
 
 		}
 
+		if abandoned || atomic.LoadInt32(&shutdown) == shutdownAbandon || ctx.Err() != nil {
+			log.Infof("Abandoned adapter %s.", adapter.ResourceKey.Name)
+			duplicates.discard()
+			summary.Status = adapterAbandoned
+			summary.finish()
+			break
+		}
+
+		for kind, count := range kinds {
+			resourcesCollected.WithLabelValues(adapter.ResourceKey.Name, kind).Set(float64(count))
+		}
+		summary.Resources = kinds
+
+		// don't let what a broken adapter listed replace what's in hostdb; a stream is left without its footer
+		if problem := listingProblem(adapter, listed); problem != "" {
+			log.Warnf("Adapter %s is unhealthy, not sending: %s.", adapter.ResourceKey.Name, problem)
+			summary.unhealthy(problem)
+			summary.finish()
+			uncollected = append(uncollected, adapter.ResourceKey.Name)
+			duplicates.discard()
+			continue
+		}
+
+		// it's going to be delivered, so the other adapters' resources are checked against it from now on
+		duplicates.commit()
+
+		// what was collected is still delivered, but the run will fail
+		if incomplete {
+			summary.Status = adapterPartial
+			summary.Reason = "some pages of resources couldn't be collected"
+			uncollected = append(uncollected, adapter.ResourceKey.Name)
+		}
+
+		// a streamed recordset is already complete
+		if stream != nil {
+			if err := stream.Close(); err != nil {
+				summary.Sends["stream"] = sendFailed
+				summary.fail(err.Error())
+				summary.finish()
+				return withExitCode(exitSend, err)
+			}
+			summary.Sends["stream"] = sendOK
+			summary.finish()
+			log.Infof("Adapter %s %s.", adapter.ResourceKey.Name, transferred)
+			continue
+		}
+
 		// create a recordset
 		recordSet := createRecordSet(adapter, records)
 
-		// post to HostDB
-		if config.Collector.SampleData {
-			if err := recordSet.Save(fmt.Sprintf("/sample-data/%s.json", recordSet.Context["vc_url"])); err != nil {
-				log.Fatal(err)
+		// compare against the previous run; missing pages would only show up as removed resources
+		if config.Collector.Diff && !incomplete {
+			if err := reportDiff(recordSet); err != nil {
+				log.WithError(err).Warn("Unable to report the differences from the previous run.")
 			}
-		} else {
-			if err := recordSet.Send(fmt.Sprintf("vc_url=%s", recordSet.Context["vc_url"])); err != nil {
-				log.Fatal(err)
+		}
+
+		// deliver to each of the sinks, e.g. post to HostDB
+		failed := false
+		for _, sink := range sinks {
+			if err := sink.Write(ctx, recordSet); err != nil {
+				log.WithError(err).Errorf("Failed to write to %s.", sink.Name())
+
+				summary.Errors = append(summary.Errors, fmt.Sprintf("%s: %s", sink.Name(), err))
+				failed = true
+
+				// keep what couldn't be sent to hostdb, to be replayed later; it still hasn't been delivered
+				if _, ok := sink.(hostdbSink); ok && config.Hostdb.SpoolDir != "" {
+					spooled, spoolErr := spoolRecordSet(recordSet)
+					if spoolErr == nil {
+						log.Infof("Spooled to %s.", spooled)
+						summary.Sends[sink.Name()] = sendSpooled
+						continue
+					}
+					log.WithError(spoolErr).Error("Unable to spool.")
+				}
+
+				summary.Sends[sink.Name()] = sendFailed
+				continue
 			}
+			summary.Sends[sink.Name()] = sendOK
 		}
+		summary.finish()
+		if failed {
+			summary.fail("unable to deliver records")
+			undelivered = append(undelivered, adapter.ResourceKey.Name)
+			continue
+		}
+
+		// keep a complete, delivered recordset for the next run to compare against
+		if config.Collector.Diff && !incomplete {
+			if err := saveSnapshot(recordSet); err != nil {
+				log.WithError(err).Warn("Unable to save the snapshot for the next run.")
+			}
+		}
+
+		log.Infof("Adapter %s %s.", adapter.ResourceKey.Name, transferred)
 
 	}
 
 	// TODO: Waiting on TVE-366
 	// logout from vrops, destroy session
-	//log.Println("Closing vrops session...")
+	//log.Info("Closing vrops session...")
 	//if deleteResponse, err := httpRequest(
+	//	ctx,
 	//	"POST",
 	//	fmt.Sprintf("%s/suite-api/api/auth/token/release", config.Vrops.Host),
 	//	nil,
 	//	vropsSessionHeaders,
 	//); err != nil {
-	//	log.Println(fmt.Sprintf("%s", deleteResponse))
-	//	log.Println(err) // don't die just because we couldn't expire the token
+	//	log.Infof("%s", deleteResponse)
+	//	log.Warn(err) // don't die just because we couldn't expire the token
 	//}
 
-	log.Println("All done!")
+	log.Info("All done!")
+
+	// carry on with the other adapters, but don't let the failures go unnoticed
+	if len(undelivered) > 0 {
+		return withExitCode(exitSend, fmt.Errorf("unable to deliver records for %s", strings.Join(undelivered, ", ")))
+	}
+	if ctx.Err() != nil {
+		return withExitCode(exitCollection, fmt.Errorf("collection cancelled: %v", ctx.Err()))
+	}
+	if len(uncollected) > 0 {
+		return withExitCode(exitCollection, fmt.Errorf("unable to collect all of %s", strings.Join(uncollected, ", ")))
+	}
+
+	return nil
+
+}
+
+// check the adapter against the include and exclude filters in config
+func adapterSelected(adapter vropsAdapterInstance) bool {
+
+	if len(config.Collector.Include) > 0 && !adapterMatches(adapter, config.Collector.Include) {
+		return false
+	}
+
+	return !adapterMatches(adapter, config.Collector.Exclude)
+
+}
+
+// does the adapter ID, name or vCenter URL match any of the patterns
+func adapterMatches(adapter vropsAdapterInstance, patterns []string) bool {
+
+	for _, pattern := range patterns {
+		for _, value := range []string{adapter.ID, adapter.ResourceKey.Name, adapter.VcURL()} {
+			if value == "" {
+				continue
+			}
+			if matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(value)); err == nil && matched {
+				return true
+			}
+		}
+	}
+
+	return false
 
 }
 
-func httpRequest(method string, url string, body io.Reader, header map[string]string) (bytes []byte, err error) {
+func httpRequest(ctx context.Context, method string, url string, body io.Reader, header map[string]string) (bytes []byte, err error) {
 
 	var res *http.Response
 
-	// Client
-	client := &http.Client{}
-	req, err := http.NewRequest(method, url, body)
+	// a gzip content encoding means the body should be compressed on the way out
+	if body != nil {
+		buffered, err := bufferBody(body, header["Content-Encoding"] == "gzip")
+		if err != nil {
+			return nil, err
+		}
+		body = buffered
+	}
+
+	// give up on a single request after a while
+	if config.Collector.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Collector.RequestTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	// INSECURE
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	// ask for a compressed response; asking explicitly means we handle decompression ourselves, and can count the bytes
+	req.Header.Set("Accept-Encoding", "gzip")
 
 	// headers
 	if len(header) > 0 {
 		for k, v := range header {
-			req.Header.Add(k, v)
+			req.Header.Set(k, v)
 		}
 	}
 
-	res, err = client.Do(req)
+	started := time.Now()
+	res, err = httpClient.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		observeRequest(method, url, "error", started)
+		return nil, err
 	}
+	observeRequest(method, url, strconv.Itoa(res.StatusCode), started)
 
-	bytes, err = ioutil.ReadAll(res.Body)
-	if err != nil {
-		log.Fatal(err)
+	bytes, err = readBody(res.Body, res.Header.Get("Content-Encoding"))
+	if closeErr := res.Body.Close(); closeErr != nil && err == nil {
+		err = closeErr
 	}
-
-	err = res.Body.Close()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	if res.StatusCode != 200 {
@@ -186,23 +558,23 @@ func httpRequest(method string, url string, body io.Reader, header map[string]st
 
 }
 
-func requestToStruct(url string, obj interface{}) (err error) {
+func requestToStruct(ctx context.Context, url string, obj interface{}) (err error) {
 
 	response, err := httpRequest(
+		ctx,
 		"GET",
 		url,
 		nil,
 		vropsSessionHeaders,
 	)
 	if err != nil {
-		log.Println(fmt.Sprintf("%v", response))
+		log.Infof("%v", response)
 		return err
 	}
 
 	// unmarshal the response into a struct
 	if err := json.Unmarshal(response, &obj); err != nil {
-		log.Fatal(err)
-		return err // i know this is kinda pointless, but i want it here
+		return err
 	}
 
 	return nil
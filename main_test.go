@@ -1,18 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestMain(m *testing.M) {
 
-	loadConfig()
+	if err := loadConfig(); err != nil {
+		panic(err)
+	}
 
 	os.Exit(m.Run())
 
@@ -35,7 +44,7 @@ func TestHttpRequest(t *testing.T) {
 		"test": "yes",
 	}
 
-	responseBytes, err := httpRequest("GET", ts.URL, nil, header)
+	responseBytes, err := httpRequest(context.Background(), "GET", ts.URL, nil, header)
 	if err != nil {
 		t.Errorf("%v", err)
 	}
@@ -44,6 +53,144 @@ func TestHttpRequest(t *testing.T) {
 
 }
 
+func TestHttpRequestGzip(t *testing.T) {
+
+	testString := "Hello World."
+
+	// setup fake http server for test, which compresses the response, and expects a compressed request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		assert.Equal(t, "gzip", r.Header.Get("Accept-Encoding"), "accept-encoding")
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"), "content-encoding")
+
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, "ping", string(body), "request body")
+
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		if _, err := fmt.Fprint(zw, testString); err != nil {
+			t.Errorf("%v", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Errorf("%v", err)
+		}
+
+	}))
+	defer ts.Close()
+
+	responseBytes, err := httpRequest(context.Background(), "POST", ts.URL, strings.NewReader("ping"), map[string]string{"Content-Encoding": "gzip"})
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+
+	assert.Equal(t, []byte(testString), responseBytes)
+
+}
+
+func TestHttpRequestContentLength(t *testing.T) {
+
+	// setup fake http server for test, which redirects once, expecting the body to be sent again
+	redirected := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		assert.Equal(t, int64(len(body)), r.ContentLength, "content-length")
+		assert.Empty(t, r.TransferEncoding, "not chunked")
+
+		if !redirected {
+			redirected = true
+			http.Redirect(w, r, "/again", http.StatusTemporaryRedirect)
+			return
+		}
+		assert.Equal(t, "/again", r.URL.Path, "redirected")
+
+	}))
+	defer ts.Close()
+
+	for _, header := range []map[string]string{nil, {"Content-Encoding": "gzip"}} {
+		redirected = false
+		_, err := httpRequest(context.Background(), "POST", ts.URL, strings.NewReader("ping"), header)
+		assert.NoError(t, err)
+		assert.True(t, redirected, "redirected")
+	}
+
+}
+
+func TestHttpRequestTimeout(t *testing.T) {
+
+	// setup fake http server for test, which hangs until the test is over
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	saved := config.Collector.RequestTimeout
+	defer func() { config.Collector.RequestTimeout = saved }()
+
+	// the per-request timeout
+	config.Collector.RequestTimeout = 50 * time.Millisecond
+	_, err := httpRequest(context.Background(), "GET", ts.URL, nil, nil)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "request timed out")
+
+	// cancelling the context
+	config.Collector.RequestTimeout = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = httpRequest(ctx, "GET", ts.URL, nil, nil)
+	assert.True(t, errors.Is(err, context.Canceled), "request cancelled")
+
+}
+
+func TestCollectAdaptersCancelled(t *testing.T) {
+
+	ts := testVropsServer(t)
+	defer ts.Close()
+
+	// interrupted while collecting the adapter's resources
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/properties") {
+			cancel()
+		}
+		ts.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer interrupting.Close()
+
+	saved := config
+	defer func() { config = saved }()
+	testCollectionConfig(interrupting.URL)
+
+	buf := &bytes.Buffer{}
+	output = buf
+	defer func() { output = os.Stdout }()
+
+	err := collectAdapters(ctx, []sink{stdoutSink{}}, adapterSelected)
+	assert.Equal(t, exitCollection, exitCode(err), "collection failure")
+	assert.Contains(t, err.Error(), "cancelled", "cancelled")
+	assert.Empty(t, buf.String(), "nothing delivered")
+
+	// cancelled before even logging in
+	err = collectAdapters(ctx, []sink{stdoutSink{}}, adapterSelected)
+	assert.Equal(t, exitCollection, exitCode(err), "not an auth failure")
+
+}
+
 func TestRequestToStruct(t *testing.T) {
 
 	// setup fake http server for test
@@ -59,10 +206,53 @@ func TestRequestToStruct(t *testing.T) {
 		Test bool `json:"test"`
 	}{}
 
-	if err := requestToStruct(ts.URL, &testStruct); err != nil {
+	if err := requestToStruct(context.Background(), ts.URL, &testStruct); err != nil {
 		t.Errorf("%v", err)
 	}
 
 	assert.Equal(t, testStruct.Test, true)
 
 }
+
+func TestAdapterSelected(t *testing.T) {
+
+	saved := config.Collector
+	defer func() { config.Collector = saved }()
+
+	adapter := vropsAdapterInstance{
+		ResourceKey: vropsResourceKey{
+			Name: "Test vCenter",
+			ResourceIdentifiers: []vropsResourceIdentifier{
+				{
+					IdentifierType: vropsResourceIdentifierType{Name: "VCURL"},
+					Value:          "vcenter.test.pdxfixit.com",
+				},
+			},
+		},
+		ID: "15a4759d-0b2f-4432-bbfd-9a6f4cfab7e4",
+	}
+
+	config.Collector.Include = nil
+	config.Collector.Exclude = nil
+	assert.True(t, adapterSelected(adapter), "no filters")
+
+	config.Collector.Include = []string{"15a4759d-0b2f-4432-bbfd-9a6f4cfab7e4"}
+	assert.True(t, adapterSelected(adapter), "include by id")
+
+	config.Collector.Include = []string{"test vcenter"}
+	assert.True(t, adapterSelected(adapter), "include by name")
+
+	config.Collector.Include = []string{"*.test.pdxfixit.com"}
+	assert.True(t, adapterSelected(adapter), "include by vcurl glob")
+
+	config.Collector.Include = []string{"vcenter.prod.pdxfixit.com"}
+	assert.False(t, adapterSelected(adapter), "not included")
+
+	config.Collector.Include = nil
+	config.Collector.Exclude = []string{"vcenter.test.pdxfixit.com"}
+	assert.False(t, adapterSelected(adapter), "excluded by vcurl")
+
+	config.Collector.Include = []string{"*.pdxfixit.com"}
+	assert.False(t, adapterSelected(adapter), "exclude wins over include")
+
+}
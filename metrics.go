@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	log "github.com/sirupsen/logrus"
+)
+
+// our own registry, so a push only includes the collector's metrics
+var metrics = prometheus.NewRegistry()
+
+var (
+	runDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "hostdb_collector_vrops_run_duration_seconds",
+		Help: "How long the last collection run took.",
+	})
+	lastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "hostdb_collector_vrops_last_success_timestamp_seconds",
+		Help: "When the last collection run finished without error.",
+	})
+	resourcesCollected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hostdb_collector_vrops_resources",
+		Help: "Number of records produced for each adapter, by kind, in the last collection.",
+	}, []string{"adapter", "kind"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hostdb_collector_vrops_http_request_duration_seconds",
+		Help:    "Latency of http requests, e.g. to vROps, by target, method and status code.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"target", "method", "code"})
+	skippedCollections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hostdb_collector_vrops_skipped_collections_total",
+		Help: "Number of scheduled collections skipped in daemon mode as another was still running, by schedule.",
+	}, []string{"schedule"})
+	hostdbSends = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hostdb_collector_vrops_hostdb_sends_total",
+		Help: "Number of recordsets sent to HostDB, however many chunks each took, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+
+	metrics.MustRegister(
+		runDuration,
+		lastSuccess,
+		resourcesCollected,
+		httpRequestDuration,
+		skippedCollections,
+		hostdbSends,
+	)
+
+}
+
+// record the latency and outcome of an http request; the code is the status code, or error when there was no response
+func observeRequest(method string, url string, code string, started time.Time) {
+
+	target := "other"
+	switch {
+	case config.Vrops.Host != "" && strings.HasPrefix(url, config.Vrops.Host):
+		target = "vrops"
+	case config.Hostdb.URL != "" && strings.HasPrefix(url, config.Hostdb.URL):
+		target = "hostdb"
+	}
+
+	httpRequestDuration.WithLabelValues(target, method, code).Observe(time.Since(started).Seconds())
+
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metrics, promhttp.HandlerOpts{})
+}
+
+// serve the metrics over http, for scraping
+func serveMetrics(listen string) {
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+
+	log.Infof("Serving metrics on %s/metrics...", listen)
+	if err := http.ListenAndServe(listen, mux); err != nil {
+		log.WithError(err).Error("Unable to serve metrics.")
+	}
+
+}
+
+// push the metrics to a prometheus pushgateway
+// a push replaces everything for the job, so after a failed run the rest are added instead, keeping the last success time
+func pushMetrics(succeeded bool) (err error) {
+
+	pusher := push.New(config.Metrics.Pushgateway, config.Metrics.Job)
+
+	if succeeded {
+		return pusher.Gatherer(metrics).Push()
+	}
+
+	for _, c := range []prometheus.Collector{runDuration, resourcesCollected, httpRequestDuration, skippedCollections, hostdbSends} {
+		pusher = pusher.Collector(c)
+	}
+
+	return pusher.Add()
+
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObserveRequest(t *testing.T) {
+
+	saved := config
+	defer func() { config = saved }()
+
+	config.Vrops.Host = "https://vrops.test.pdxfixit.com"
+	config.Hostdb.URL = "https://hostdb.test.pdxfixit.com/v0/records/"
+
+	httpRequestDuration.Reset()
+
+	observeRequest("GET", "https://vrops.test.pdxfixit.com/suite-api/api/adapters", "200", time.Now())
+	observeRequest("GET", "https://vrops.test.pdxfixit.com/suite-api/api/adapters", "200", time.Now())
+	observeRequest("POST", "https://hostdb.test.pdxfixit.com/v0/records/?vc_url=foo", "500", time.Now())
+	observeRequest("POST", "https://hostdb.test.pdxfixit.com/v0/records/?vc_url=foo", "error", time.Now())
+	observeRequest("POST", "https://example.pdxfixit.com/hook", "200", time.Now())
+
+	assert.Equal(t, 4, testutil.CollectAndCount(httpRequestDuration), "one series per target, method and code")
+
+	rec := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Contains(t, rec.Body.String(), `hostdb_collector_vrops_http_request_duration_seconds_count{code="200",method="GET",target="vrops"} 2`, "vrops")
+	assert.Contains(t, rec.Body.String(), `hostdb_collector_vrops_http_request_duration_seconds_count{code="500",method="POST",target="hostdb"} 1`, "hostdb")
+	assert.Contains(t, rec.Body.String(), `hostdb_collector_vrops_http_request_duration_seconds_count{code="error",method="POST",target="hostdb"} 1`, "no response")
+	assert.Contains(t, rec.Body.String(), `hostdb_collector_vrops_http_request_duration_seconds_count{code="200",method="POST",target="other"} 1`, "other")
+
+}
+
+func TestMetricsHandler(t *testing.T) {
+
+	hostdbSends.Reset()
+	hostdbSends.WithLabelValues("success").Inc()
+
+	rec := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, 200, rec.Code, "status")
+	assert.Contains(t, rec.Body.String(), `hostdb_collector_vrops_hostdb_sends_total{result="success"} 1`, "send counter")
+
+}
+
+func TestPushMetrics(t *testing.T) {
+
+	saved := config.Metrics
+	defer func() { config.Metrics = saved }()
+
+	var method, path, body string
+
+	// setup fake pushgateway for test
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		path = r.URL.Path
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		body = string(data)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	config.Metrics.Pushgateway = ts.URL
+	config.Metrics.Job = "hostdb-collector-vrops"
+
+	lastSuccess.SetToCurrentTime()
+
+	assert.NoError(t, pushMetrics(true))
+	assert.Equal(t, "PUT", method, "replacing the job's metrics")
+	assert.Equal(t, "/metrics/job/hostdb-collector-vrops", path, "job")
+	assert.Contains(t, body, "hostdb_collector_vrops_last_success_timestamp_seconds", "last success pushed")
+
+	// a failed run leaves the last success time as it was
+	vrops := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusUnauthorized)
+	}))
+	defer vrops.Close()
+
+	savedConfig := config
+	defer func() { config = savedConfig }()
+	testCollectionConfig(vrops.URL)
+
+	err := collectAdapters(context.Background(), []sink{stdoutSink{}}, adapterSelected)
+	assert.Error(t, err, "the run fails")
+
+	assert.NoError(t, pushMetrics(err == nil))
+	assert.Equal(t, "POST", method, "adding to the job's metrics")
+	assert.Contains(t, body, "hostdb_collector_vrops_run_duration_seconds", "run duration pushed")
+	assert.NotContains(t, body, "hostdb_collector_vrops_last_success_timestamp_seconds", "last success not pushed")
+
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+	run_id:           0123456789abcdef0123456789abcdef
+	started:          2019-01-01T00:00:00Z
+	finished:         2019-01-01T00:05:00Z
+	duration_seconds: 300
+	adapters:         []
+	error:            unable to deliver records for vcenter.pdxfixit.com
+*/
+type runReport struct {
+	RunID    string           `json:"run_id"`
+	Started  time.Time        `json:"started"`
+	Finished time.Time        `json:"finished"`
+	Duration float64          `json:"duration_seconds"`
+	Adapters []*adapterReport `json:"adapters"`
+	Error    string           `json:"error,omitempty"`
+}
+
+/*
+	id:               15a4759d-0b2f-4432-bbfd-9a6f4cfab7e4
+	name:             vcenter.pdxfixit.com
+	vc_url:           vcenter.pdxfixit.com
+	status:           ok
+	reason:           ""
+	resources:        { HostSystem: 12, VirtualMachine: 340 }
+	records:          352
+	skipped:          { Datastore: 20 }
+	stale:            { VirtualMachine: 3 }
+	failed:           []
+	duplicates:       []
+	errors:           []
+	bytes:            {}
+	sends:            { hostdb: ok }
+	started:          2019-01-01T00:00:00Z
+	duration_seconds: 42.5
+*/
+type adapterReport struct {
+	ID         string              `json:"id"`
+	Name       string              `json:"name"`
+	VcURL      string              `json:"vc_url,omitempty"`
+	Status     string              `json:"status"`
+	Reason     string              `json:"reason,omitempty"`
+	Resources  map[string]int      `json:"resources"`
+	Records    int                 `json:"records"`
+	Skipped    map[string]int      `json:"skipped"`
+	Stale      map[string]int      `json:"stale"`
+	Failed     []resourceFailure   `json:"failed"`
+	Duplicates []resourceDuplicate `json:"duplicates"`
+	Errors     []string            `json:"errors"`
+	Bytes      bytesReport         `json:"bytes"`
+	Sends      map[string]string   `json:"sends"`
+	Started    time.Time           `json:"started"`
+	Duration   float64             `json:"duration_seconds"`
+}
+
+/*
+	identifier: 2fb6adf9-7665-4bec-9d53-e49c5a71d63a
+	kind:       VirtualMachine
+	reason:     404 Not Found
+*/
+type resourceFailure struct {
+	Identifier string `json:"identifier"`
+	Kind       string `json:"kind"`
+	Reason     string `json:"reason"`
+}
+
+/*
+	identifier:   01afa5ae-216f-4b27-91a7-43abfe5d5905
+	kind:         VirtualMachine
+	match:        instance_uuid
+	duplicate_of: {}
+*/
+type resourceDuplicate struct {
+	Identifier  string          `json:"identifier"`
+	Kind        string          `json:"kind"`
+	Match       string          `json:"match"`
+	DuplicateOf duplicateSource `json:"duplicate_of"`
+}
+
+/*
+	sent:          1048576
+	sent_wire:     131072
+	received:      8388608
+	received_wire: 1048576
+*/
+type bytesReport struct {
+	Sent         int64 `json:"sent"`
+	SentWire     int64 `json:"sent_wire"`
+	Received     int64 `json:"received"`
+	ReceivedWire int64 `json:"received_wire"`
+}
+
+// adapter statuses
+const (
+	adapterOK        = "ok"
+	adapterSkipped   = "skipped"
+	adapterUnhealthy = "unhealthy"
+	adapterPartial   = "partial"
+	adapterFailed    = "failed"
+	adapterAbandoned = "abandoned"
+)
+
+// send outcomes
+const (
+	sendOK      = "ok"
+	sendFailed  = "failed"
+	sendSpooled = "spooled"
+)
+
+func newRunReport(id string) *runReport {
+
+	return &runReport{
+		RunID:    id,
+		Started:  time.Now().UTC(),
+		Adapters: []*adapterReport{},
+	}
+
+}
+
+// start reporting on an adapter
+func (r *runReport) adapter(adapter vropsAdapterInstance) *adapterReport {
+
+	a := &adapterReport{
+		ID:         adapter.ID,
+		Name:       adapter.ResourceKey.Name,
+		VcURL:      adapter.VcURL(),
+		Status:     adapterOK,
+		Resources:  map[string]int{},
+		Skipped:    map[string]int{},
+		Stale:      map[string]int{},
+		Failed:     []resourceFailure{},
+		Duplicates: []resourceDuplicate{},
+		Errors:     []string{},
+		Sends:      map[string]string{},
+		Started:    time.Now().UTC(),
+	}
+	r.Adapters = append(r.Adapters, a)
+
+	return a
+
+}
+
+// the run is over
+func (r *runReport) finish(err error) {
+
+	r.Finished = time.Now().UTC()
+	r.Duration = r.Finished.Sub(r.Started).Seconds()
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+}
+
+// the adapter is over; record how long it took, and what was transferred
+func (a *adapterReport) finish() {
+
+	a.Duration = time.Since(a.Started).Seconds()
+	a.Bytes = transferred.report()
+
+}
+
+// the adapter wasn't collected, and why
+func (a *adapterReport) skip(reason string) {
+
+	a.Status = adapterSkipped
+	a.Reason = reason
+
+}
+
+// the adapter wasn't collected, as it isn't healthy, and why
+func (a *adapterReport) unhealthy(reason string) {
+
+	a.Status = adapterUnhealthy
+	a.Reason = reason
+
+}
+
+// the adapter couldn't be collected or delivered, and why
+func (a *adapterReport) fail(reason string) {
+
+	a.Status = adapterFailed
+	a.Reason = reason
+
+}
+
+// a resource of a kind that isn't collected; safe to call without a report
+func (a *adapterReport) skipResource(resource vropsResource) {
+
+	if a == nil {
+		return
+	}
+
+	a.Skipped[resource.ResourceKey.ResourceKindKey]++
+
+}
+
+// a resource which vROps has lost track of, or isn't getting data for; safe to call without a report
+func (a *adapterReport) staleResource(resource vropsResource) {
+
+	if a == nil {
+		return
+	}
+
+	a.Stale[resource.ResourceKey.ResourceKindKey]++
+
+}
+
+// a resource which couldn't be collected; safe to call without a report
+func (a *adapterReport) failResource(resource vropsResource, err error) {
+
+	if a == nil {
+		return
+	}
+
+	a.Failed = append(a.Failed, resourceFailure{
+		Identifier: resource.Identifier,
+		Kind:       resource.ResourceKey.ResourceKindKey,
+		Reason:     err.Error(),
+	})
+
+}
+
+// a resource which was already collected in this run; safe to call without a report
+func (a *adapterReport) duplicateResource(resource vropsResource, original duplicateSource, match string) {
+
+	if a == nil {
+		return
+	}
+
+	a.Duplicates = append(a.Duplicates, resourceDuplicate{
+		Identifier:  resource.Identifier,
+		Kind:        resource.ResourceKey.ResourceKindKey,
+		Match:       match,
+		DuplicateOf: original,
+	})
+
+}
+
+// the current byte counts
+func (c *byteCounters) report() bytesReport {
+
+	return bytesReport{
+		Sent:         atomic.LoadInt64(&c.sent),
+		SentWire:     atomic.LoadInt64(&c.sentWire),
+		Received:     atomic.LoadInt64(&c.received),
+		ReceivedWire: atomic.LoadInt64(&c.receivedWire),
+	}
+
+}
+
+// summarise the run in the log, one line per adapter
+func (r *runReport) log() {
+
+	for _, a := range r.Adapters {
+
+		kinds := make([]string, 0, len(a.Resources))
+		for kind := range a.Resources {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+
+		stale := 0
+		for _, n := range a.Stale {
+			stale += n
+		}
+
+		entry := log.WithFields(log.Fields{
+			"status":           a.Status,
+			"records":          a.Records,
+			"failed":           len(a.Failed),
+			"duplicates":       len(a.Duplicates),
+			"stale":            stale,
+			"errors":           len(a.Errors),
+			"bytes_sent":       a.Bytes.SentWire,
+			"bytes_received":   a.Bytes.ReceivedWire,
+			"duration_seconds": a.Duration,
+		})
+		for _, kind := range kinds {
+			entry = entry.WithField("kind_"+kind, a.Resources[kind])
+		}
+		for sink, outcome := range a.Sends {
+			entry = entry.WithField("send_"+sink, outcome)
+		}
+		if a.Reason != "" {
+			entry = entry.WithField("reason", a.Reason)
+		}
+
+		entry.Infof("Summary for adapter %s.", a.Name)
+
+	}
+
+	log.Infof("Run %s took %.1fs over %d adapters.", r.RunID, r.Duration, len(r.Adapters))
+
+}
+
+// write the report out as json; write then rename, so monitoring never reads half a report
+func (r *runReport) write(path string) error {
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+
+}
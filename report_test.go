@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdapterReport(t *testing.T) {
+
+	report := newRunReport("test-run")
+	adapter := report.adapter(vropsAdapterInstance{
+		ID:          "15a4759d-0b2f-4432-bbfd-9a6f4cfab7e4",
+		ResourceKey: vropsResourceKey{Name: "Test Adapter"},
+	})
+
+	assert.Equal(t, adapterOK, adapter.Status, "ok until shown otherwise")
+	assert.Len(t, report.Adapters, 1, "adapter added to the run")
+
+	vm := vropsResource{Identifier: "vm-1", ResourceKey: vropsResourceKey{ResourceKindKey: "VirtualMachine"}}
+	ds := vropsResource{Identifier: "ds-1", ResourceKey: vropsResourceKey{ResourceKindKey: "Datastore"}}
+
+	adapter.skipResource(ds)
+	adapter.skipResource(ds)
+	adapter.failResource(vm, errors.New("404 Not Found"))
+
+	assert.Equal(t, map[string]int{"Datastore": 2}, adapter.Skipped, "skipped per kind")
+	assert.Equal(t, []resourceFailure{{Identifier: "vm-1", Kind: "VirtualMachine", Reason: "404 Not Found"}}, adapter.Failed, "failures with reasons")
+
+	// without a report, there's nothing to note
+	var none *adapterReport
+	none.skipResource(ds)
+	none.failResource(vm, errors.New("404 Not Found"))
+
+	adapter.fail("unable to deliver records")
+	assert.Equal(t, adapterFailed, adapter.Status, "failed")
+	assert.Equal(t, "unable to deliver records", adapter.Reason, "reason")
+
+	report.finish(errors.New("unable to deliver records for vcenter.test.pdxfixit.com"))
+	assert.False(t, report.Finished.Before(report.Started), "finished after starting")
+	assert.Equal(t, "unable to deliver records for vcenter.test.pdxfixit.com", report.Error, "run error")
+
+}
+
+func TestRunReportWrite(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { assert.NoError(t, os.RemoveAll(dir)) }()
+
+	report := newRunReport("test-run")
+	report.adapter(vropsAdapterInstance{ID: "test-adapter"}).skip("not selected")
+	report.finish(nil)
+
+	path := filepath.Join(dir, "reports", "report.json")
+	assert.NoError(t, report.write(path))
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var written runReport
+	assert.NoError(t, json.Unmarshal(data, &written))
+	assert.Equal(t, "test-run", written.RunID, "run id")
+	assert.Equal(t, adapterSkipped, written.Adapters[0].Status, "adapter status")
+	assert.Equal(t, "not selected", written.Adapters[0].Reason, "adapter reason")
+
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1, "no temporary file left behind")
+
+}
+
+func TestCollectAdaptersReport(t *testing.T) {
+
+	ts := testVropsServer(t)
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { assert.NoError(t, os.RemoveAll(dir)) }()
+
+	saved := config
+	defer func() { config = saved }()
+
+	config.Vrops.Host = ts.URL
+	config.Vrops.PageSize = 1000
+	config.Vrops.ResourceKindKeys = []string{"HostSystem"}
+	config.Collector.Include = nil
+	config.Collector.Exclude = nil
+	config.Collector.Stream = ""
+	config.Collector.Report = filepath.Join(dir, "report.json")
+	config.Hostdb.SpoolDir = ""
+
+	buf := &bytes.Buffer{}
+	output = buf
+	defer func() { output = os.Stdout }()
+
+	assert.NoError(t, collectAdapters(context.Background(), []sink{stdoutSink{}}, adapterSelected))
+
+	data, err := ioutil.ReadFile(config.Collector.Report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report runReport
+	assert.NoError(t, json.Unmarshal(data, &report))
+	assert.Equal(t, runID, report.RunID, "run id")
+	assert.Empty(t, report.Error, "no error")
+
+	if assert.Len(t, report.Adapters, 1, "one adapter") {
+		adapter := report.Adapters[0]
+		assert.Equal(t, adapterOK, adapter.Status, "status")
+		assert.Equal(t, "vcenter.test.pdxfixit.com", adapter.VcURL, "vc url")
+		assert.Equal(t, 1, adapter.Records, "records")
+		assert.Equal(t, map[string]int{"HostSystem": 1}, adapter.Resources, "resources per kind")
+		assert.Equal(t, map[string]string{"stdout": sendOK}, adapter.Sends, "send outcome")
+		assert.NotZero(t, adapter.Bytes.Received, "bytes received")
+	}
+
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// somewhere to fetch secrets from, e.g. vault
+type secretProvider interface {
+	Name() string
+	Secret(ctx context.Context, path string, key string) (string, error)
+}
+
+// build the secret provider from config; nil when there isn't one
+func newSecretProvider(sc secretsConfig) (p secretProvider, err error) {
+
+	switch sc.Provider {
+	case "":
+		return nil, nil
+	case "vault":
+		if sc.Vault.URL == "" {
+			return nil, fmt.Errorf("the vault secret provider requires a url")
+		}
+		return vaultProvider{
+			url:       strings.TrimRight(sc.Vault.URL, "/"),
+			mount:     sc.Vault.Mount,
+			token:     sc.Vault.Token,
+			tokenFile: sc.Vault.TokenFile,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown secret provider %q", sc.Provider)
+
+}
+
+// look up a credential, every time it's needed, so that rotations are picked up without a restart
+// a secret reference (path#key) takes precedence over a file, which takes precedence over the value itself
+func resolveSecret(ctx context.Context, value string, file string, ref string) (secret string, err error) {
+
+	switch {
+	case ref != "":
+		provider, err := newSecretProvider(config.Secrets)
+		if err != nil {
+			return "", err
+		}
+		if provider == nil {
+			return "", fmt.Errorf("no secret provider is configured for %s", ref)
+		}
+
+		path, key, err := splitSecretRef(ref)
+		if err != nil {
+			return "", err
+		}
+
+		if secret, err = provider.Secret(ctx, path, key); err != nil {
+			return "", fmt.Errorf("unable to get %s from %s: %v", ref, provider.Name(), err)
+		}
+	case file != "":
+		if secret, err = readSecretFile(file); err != nil {
+			return "", err
+		}
+	default:
+		secret = value
+	}
+
+	// whatever it is, it's not for the logs
+	registerSecret(secret)
+
+	return secret, nil
+
+}
+
+// a secret reference is a path, and the key within it, e.g. hostdb-collector-vrops/vrops#pass
+func splitSecretRef(ref string) (path string, key string, err error) {
+
+	parts := strings.SplitN(ref, "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("secret reference %q should look like path#key", ref)
+	}
+
+	return parts[0], parts[1], nil
+
+}
+
+// read a secret from a file, e.g. a mounted kubernetes secret; trailing newlines aren't part of it
+func readSecretFile(path string) (string, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+
+}
+
+// the vrops password
+func vropsPass(ctx context.Context) (string, error) {
+
+	return resolveSecret(ctx, config.Vrops.Pass, config.Vrops.PassFile, config.Vrops.PassSecret)
+
+}
+
+// the hostdb password
+func hostdbPass(ctx context.Context) (string, error) {
+
+	return resolveSecret(ctx, config.Hostdb.Pass, config.Hostdb.PassFile, config.Hostdb.PassSecret)
+
+}
+
+// read secrets from vault's http api, or anything compatible with it
+type vaultProvider struct {
+	url       string
+	mount     string
+	token     string
+	tokenFile string
+}
+
+func (p vaultProvider) Name() string {
+	return fmt.Sprintf("vault %s", p.url)
+}
+
+/*
+	data:
+	  data:     { pass: password }
+	  metadata: { version: 3 }
+*/
+type vaultSecret struct {
+	Data json.RawMessage `json:"data"`
+}
+
+func (p vaultProvider) Secret(ctx context.Context, path string, key string) (secret string, err error) {
+
+	// the token may be rotated too
+	token, err := resolveSecret(ctx, p.token, p.tokenFile, "")
+	if err != nil {
+		return "", err
+	}
+
+	// where the kv version 2 engine is mounted
+	mount := p.mount
+	if mount == "" {
+		mount = "secret"
+	}
+
+	response, err := httpRequest(
+		ctx,
+		"GET",
+		fmt.Sprintf("%s/v1/%s/data/%s", p.url, mount, strings.TrimLeft(path, "/")),
+		nil,
+		map[string]string{
+			"Accept":        "application/json",
+			"X-Vault-Token": token,
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	// kv version 2 nests the secret in another data, alongside metadata
+	outer := vaultSecret{}
+	if err := json.Unmarshal(response, &outer); err != nil {
+		return "", err
+	}
+	inner := vaultSecret{}
+	if err := json.Unmarshal(outer.Data, &inner); err != nil {
+		return "", err
+	}
+
+	values := map[string]interface{}{}
+	if err := json.Unmarshal(inner.Data, &values); err != nil {
+		return "", err
+	}
+
+	value, ok := values[key]
+	if !ok {
+		return "", fmt.Errorf("%s has no %s", path, key)
+	}
+
+	return fmt.Sprintf("%v", value), nil
+
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// a stand-in for vault's kv version 2 api
+func testVaultServer(t *testing.T, secrets map[string]map[string]string) *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Header.Get("X-Vault-Token") != "test-vault-token" {
+			http.Error(w, "{\"errors\":[\"permission denied\"]}", http.StatusForbidden)
+			return
+		}
+
+		data, ok := secrets[r.URL.Path]
+		if !ok {
+			http.Error(w, "{\"errors\":[]}", http.StatusNotFound)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"data":     data,
+				"metadata": map[string]interface{}{"version": 1},
+			},
+		}); err != nil {
+			t.Error(err)
+		}
+
+	}))
+
+}
+
+func TestVaultProvider(t *testing.T) {
+
+	ts := testVaultServer(t, map[string]map[string]string{
+		"/v1/secret/data/hostdb-collector-vrops/vrops": {"pass": "hunter2"},
+	})
+	defer ts.Close()
+
+	provider, err := newSecretProvider(secretsConfig{
+		Provider: "vault",
+		Vault:    vaultConfig{URL: ts.URL + "/", Token: "test-vault-token"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := provider.Secret(context.Background(), "hostdb-collector-vrops/vrops", "pass")
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", secret, "secret")
+
+	_, err = provider.Secret(context.Background(), "hostdb-collector-vrops/vrops", "user")
+	assert.Error(t, err, "no such key")
+
+	_, err = provider.Secret(context.Background(), "hostdb-collector-vrops/hostdb", "pass")
+	assert.Error(t, err, "no such secret")
+
+	// the wrong token
+	provider = vaultProvider{url: ts.URL, token: "wrong"}
+	_, err = provider.Secret(context.Background(), "hostdb-collector-vrops/vrops", "pass")
+	assert.Error(t, err, "permission denied")
+
+}
+
+func TestNewSecretProvider(t *testing.T) {
+
+	provider, err := newSecretProvider(secretsConfig{})
+	assert.NoError(t, err)
+	assert.Nil(t, provider, "none configured")
+
+	_, err = newSecretProvider(secretsConfig{Provider: "vault"})
+	assert.Error(t, err, "vault requires a url")
+
+	_, err = newSecretProvider(secretsConfig{Provider: "keychain"})
+	assert.Error(t, err, "unknown provider")
+
+}
+
+func TestResolveSecret(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { assert.NoError(t, os.RemoveAll(dir)) }()
+
+	ts := testVaultServer(t, map[string]map[string]string{
+		"/v1/kv/data/hostdb-collector-vrops/vrops": {"pass": "from-vault"},
+	})
+	defer ts.Close()
+
+	saved := config
+	defer func() { config = saved }()
+
+	// the vault token comes from a file too
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("test-vault-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.Secrets = secretsConfig{Provider: "vault", Vault: vaultConfig{URL: ts.URL, Mount: "kv", TokenFile: tokenFile}}
+
+	passFile := filepath.Join(dir, "pass")
+	if err := ioutil.WriteFile(passFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := resolveSecret(context.Background(), "from-value", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "from-value", secret, "value")
+
+	secret, err = resolveSecret(context.Background(), "from-value", passFile, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "from-file", secret, "file, without the newline")
+
+	secret, err = resolveSecret(context.Background(), "from-value", passFile, "hostdb-collector-vrops/vrops#pass")
+	assert.NoError(t, err)
+	assert.Equal(t, "from-vault", secret, "secret provider")
+	assert.Equal(t, redacted, redact("from-vault"), "kept out of the logs")
+
+	_, err = resolveSecret(context.Background(), "", filepath.Join(dir, "missing"), "")
+	assert.Error(t, err, "missing file")
+
+	_, err = resolveSecret(context.Background(), "", "", "hostdb-collector-vrops/vrops")
+	assert.Error(t, err, "reference without a key")
+
+	config.Secrets = secretsConfig{}
+	_, err = resolveSecret(context.Background(), "", "", "hostdb-collector-vrops/vrops#pass")
+	assert.Error(t, err, "no provider")
+
+}
+
+func TestGetSessionTokenRotation(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { assert.NoError(t, os.RemoveAll(dir)) }()
+
+	// remember the password each token was acquired with
+	var passwords []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credentials := struct {
+			Password string `json:"password"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+			t.Error(err)
+		}
+		passwords = append(passwords, credentials.Password)
+		if _, err := fmt.Fprint(w, "{\"token\":\"test-token\"}"); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	saved := config
+	defer func() { config = saved }()
+
+	config.Vrops.Host = ts.URL
+	config.Vrops.PassFile = filepath.Join(dir, "pass")
+
+	for _, pass := range []string{"first", "second"} {
+		if err := ioutil.WriteFile(config.Vrops.PassFile, []byte(pass), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := getSessionToken(context.Background())
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, []string{"first", "second"}, passwords, "re-read for each token")
+
+}
+
+func TestPassFileEnv(t *testing.T) {
+
+	// restore the config from file once done
+	defer func() {
+		viper.Reset()
+		assert.NoError(t, loadConfig())
+	}()
+
+	if err := os.Setenv("HOSTDB_COLLECTOR_VROPS_VROPS_PASS_FILE", "/var/run/secrets/vrops/pass"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { assert.NoError(t, os.Unsetenv("HOSTDB_COLLECTOR_VROPS_VROPS_PASS_FILE")) }()
+
+	if err := os.Setenv("HOSTDB_COLLECTOR_VROPS_SECRETS_VAULT_TOKEN_FILE", "/var/run/secrets/vault/token"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { assert.NoError(t, os.Unsetenv("HOSTDB_COLLECTOR_VROPS_SECRETS_VAULT_TOKEN_FILE")) }()
+
+	viper.Reset()
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "/var/run/secrets/vrops/pass", config.Vrops.PassFile, "vrops pass file")
+	assert.Equal(t, "/var/run/secrets/vault/token", config.Secrets.Vault.TokenFile, "vault token file")
+
+}
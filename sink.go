@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pdxfixit/hostdb"
+	log "github.com/sirupsen/logrus"
+)
+
+// somewhere to deliver a recordset
+type sink interface {
+	Name() string
+	Write(ctx context.Context, recordSet hostdb.RecordSet) error
+}
+
+// build the list of sinks from config
+func configuredSinks() (sinks []sink, err error) {
+
+	// sample data replaces any configured sinks
+	if config.Collector.SampleData {
+		return []sink{directorySink{path: "/sample-data"}}, nil
+	}
+
+	// without any sinks configured, just post to hostdb
+	if len(config.Collector.Sinks) == 0 {
+		return []sink{hostdbSink{}}, nil
+	}
+
+	for _, sc := range config.Collector.Sinks {
+		s, err := newSink(sc)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+
+	return sinks, nil
+
+}
+
+func newSink(sc sinkConfig) (s sink, err error) {
+
+	switch sc.Type {
+	case "hostdb":
+		return hostdbSink{}, nil
+	case "directory":
+		if sc.Path == "" {
+			return nil, fmt.Errorf("the directory sink requires a path")
+		}
+		return directorySink{path: sc.Path}, nil
+	case "stdout":
+		return stdoutSink{}, nil
+	case "webhook":
+		if sc.URL == "" {
+			return nil, fmt.Errorf("the webhook sink requires a url")
+		}
+		return webhookSink{url: sc.URL, headers: sc.Headers}, nil
+	}
+
+	return nil, fmt.Errorf("unknown sink type %q", sc.Type)
+
+}
+
+// post the recordset to hostdb
+type hostdbSink struct{}
+
+func (s hostdbSink) Name() string {
+	return "hostdb"
+}
+
+func (s hostdbSink) Write(ctx context.Context, recordSet hostdb.RecordSet) error {
+
+	// oversized recordsets are sent in pieces
+	chunks, err := chunkRecordSet(recordSet, config.Hostdb.ChunkRecords, config.Hostdb.ChunkBytes)
+	if err != nil {
+		return err
+	}
+
+	for i, chunk := range chunks {
+
+		if len(chunks) > 1 {
+			log.Infof(
+				"Sending chunk %d/%d (%d records) for %s...",
+				i+1,
+				len(chunks),
+				len(chunk.Records),
+				recordSet.Context["vc_url"],
+			)
+		}
+
+		if err := sendRecordSet(ctx, chunk, fmt.Sprintf("vc_url=%s", recordSet.Context["vc_url"])); err != nil {
+			hostdbSends.WithLabelValues("failure").Inc()
+			return fmt.Errorf("chunk %d/%d: %v", i+1, len(chunks), err)
+		}
+
+	}
+	hostdbSends.WithLabelValues("success").Inc()
+
+	// anything older waiting in the spool for this vcenter is now out of date
+	if config.Hostdb.SpoolDir != "" {
+		if err := discardSpooled(recordSet); err != nil {
+			log.WithError(err).Warn("Unable to discard superseded recordsets from the spool.")
+		}
+	}
+
+	return nil
+
+}
+
+// save the recordset as <vc_url>.json in a local directory
+type directorySink struct {
+	path string
+}
+
+func (s directorySink) Name() string {
+	return fmt.Sprintf("directory %s", s.path)
+}
+
+func (s directorySink) Write(ctx context.Context, recordSet hostdb.RecordSet) error {
+
+	if err := os.MkdirAll(s.path, 0755); err != nil {
+		return err
+	}
+
+	return recordSet.Save(filepath.Join(s.path, fmt.Sprintf("%s.json", recordSet.Context["vc_url"])))
+
+}
+
+// write the recordset to stdout, as a single line of json
+type stdoutSink struct{}
+
+func (s stdoutSink) Name() string {
+	return "stdout"
+}
+
+func (s stdoutSink) Write(ctx context.Context, recordSet hostdb.RecordSet) error {
+
+	data, err := json.Marshal(recordSet)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(output, string(data))
+
+	return err
+
+}
+
+// post the recordset as json to an arbitrary url
+type webhookSink struct {
+	url     string
+	headers map[string]string
+}
+
+func (s webhookSink) Name() string {
+	return fmt.Sprintf("webhook %s", s.url)
+}
+
+func (s webhookSink) Write(ctx context.Context, recordSet hostdb.RecordSet) error {
+
+	data, err := json.Marshal(recordSet)
+	if err != nil {
+		return err
+	}
+
+	header := map[string]string{
+		"Content-Type": "application/json",
+	}
+	for k, v := range s.headers {
+		header[k] = v
+	}
+
+	if response, err := httpRequest(ctx, "POST", s.url, bytes.NewReader(data), header); err != nil {
+		return fmt.Errorf("%v: %s", err, response)
+	}
+
+	return nil
+
+}
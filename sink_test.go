@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pdxfixit/hostdb"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+var testSinkRecordSet = hostdb.RecordSet{
+	Type:      "vrops-vmware",
+	Timestamp: "2019-01-01 00:00:00",
+	Context:   map[string]interface{}{"vc_url": "vcenter.test.pdxfixit.com"},
+	Committer: "golang tests",
+	Records: []hostdb.Record{
+		{
+			Type:      "vrops-vmware-virtualmachine",
+			Hostname:  "foo.pdxfixit.com",
+			Committer: "golang tests",
+			Data:      []byte("{\"resourceId\":\"abc123\",\"property\":[]}"),
+		},
+	},
+}
+
+func TestConfiguredSinks(t *testing.T) {
+
+	saved := config.Collector
+	defer func() { config.Collector = saved }()
+
+	config.Collector.SampleData = false
+	config.Collector.Sinks = nil
+	sinks, err := configuredSinks()
+	assert.NoError(t, err)
+	assert.Equal(t, []sink{hostdbSink{}}, sinks, "default to hostdb")
+
+	config.Collector.Sinks = []sinkConfig{
+		{Type: "hostdb"},
+		{Type: "directory", Path: "/tmp/archive"},
+		{Type: "stdout"},
+		{Type: "webhook", URL: "https://example.pdxfixit.com/hook"},
+	}
+	sinks, err = configuredSinks()
+	assert.NoError(t, err)
+	assert.Len(t, sinks, 4, "configured sinks")
+	assert.Equal(t, "directory /tmp/archive", sinks[1].Name(), "directory sink")
+
+	config.Collector.SampleData = true
+	sinks, err = configuredSinks()
+	assert.NoError(t, err)
+	assert.Equal(t, []sink{directorySink{path: "/sample-data"}}, sinks, "sample data replaces sinks")
+
+	config.Collector.SampleData = false
+	config.Collector.Sinks = []sinkConfig{{Type: "carrier-pigeon"}}
+	_, err = configuredSinks()
+	assert.Error(t, err, "unknown sink type")
+
+	config.Collector.Sinks = []sinkConfig{{Type: "webhook"}}
+	_, err = configuredSinks()
+	assert.Error(t, err, "webhook without url")
+
+}
+
+func TestHostdbSink(t *testing.T) {
+
+	saved := config.Hostdb
+	defer func() { config.Hostdb = saved }()
+
+	posts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts++
+	}))
+	defer ts.Close()
+
+	config.Hostdb.URL = ts.URL
+	config.Hostdb.Gzip = false
+	config.Hostdb.SpoolDir = ""
+	config.Hostdb.ChunkRecords = 1
+	config.Hostdb.ChunkBytes = 0
+
+	recordSet := testSinkRecordSet
+	recordSet.Records = append(append([]hostdb.Record{}, recordSet.Records...), recordSet.Records...)
+
+	hostdbSends.Reset()
+
+	// two chunks, but one recordset
+	assert.NoError(t, hostdbSink{}.Write(context.Background(), recordSet))
+	assert.Equal(t, 2, posts, "chunks")
+	assert.Equal(t, float64(1), testutil.ToFloat64(hostdbSends.WithLabelValues("success")), "sends")
+
+}
+
+func TestDirectorySink(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hostdb-collector-vrops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	s := directorySink{path: filepath.Join(dir, "archive")}
+	assert.NoError(t, s.Write(context.Background(), testSinkRecordSet))
+	assert.FileExists(t, filepath.Join(dir, "archive", "vcenter.test.pdxfixit.com.json"))
+
+}
+
+func TestStdoutSink(t *testing.T) {
+
+	buf := &bytes.Buffer{}
+	output = buf
+	defer func() { output = os.Stdout }()
+
+	assert.NoError(t, stdoutSink{}.Write(context.Background(), testSinkRecordSet))
+	assert.NoError(t, stdoutSink{}.Write(context.Background(), testSinkRecordSet))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2, "one line per recordset")
+
+	recordSet := hostdb.RecordSet{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &recordSet))
+	assert.Equal(t, testSinkRecordSet.Type, recordSet.Type, "type")
+	assert.Len(t, recordSet.Records, 1, "records")
+
+}
+
+func TestWebhookSink(t *testing.T) {
+
+	var received hostdb.RecordSet
+
+	// setup fake http server for test
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method, "method")
+		assert.Equal(t, "secret", r.Header.Get("X-Test-Token"), "custom header")
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err.Error())
+		}
+	}))
+	defer ts.Close()
+
+	s := webhookSink{url: ts.URL, headers: map[string]string{"X-Test-Token": "secret"}}
+	assert.NoError(t, s.Write(context.Background(), testSinkRecordSet))
+	assert.Equal(t, testSinkRecordSet.Context["vc_url"], received.Context["vc_url"], "context")
+	assert.Len(t, received.Records, 1, "records")
+
+}
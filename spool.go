@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pdxfixit/hostdb"
+	log "github.com/sirupsen/logrus"
+)
+
+var spoolUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// recordsets are spooled per vcenter; a newer one supersedes any older
+func spoolKey(recordSet hostdb.RecordSet) string {
+
+	return spoolUnsafe.ReplaceAllString(fmt.Sprintf("%s_%s", recordSet.Type, recordSet.Context["vc_url"]), "_")
+
+}
+
+// keep a recordset which couldn't be sent, so it can be replayed later
+func spoolRecordSet(recordSet hostdb.RecordSet) (path string, err error) {
+
+	if err := os.MkdirAll(config.Hostdb.SpoolDir, 0755); err != nil {
+		return "", err
+	}
+
+	// the timestamp prefix keeps the spool in the order things were collected
+	name := fmt.Sprintf("%020d-%s.json", time.Now().UnixNano(), spoolKey(recordSet))
+	path = filepath.Join(config.Hostdb.SpoolDir, name)
+
+	// write then rename, so a crash never leaves half a recordset in the spool
+	tmp := filepath.Join(config.Hostdb.SpoolDir, fmt.Sprintf(".%s.tmp", name))
+	if err := writeRecordSetFile(tmp, recordSet); err != nil {
+		return "", err
+	}
+
+	return path, os.Rename(tmp, path)
+
+}
+
+/*
+	path: /var/lib/hostdb-collector-vrops/spool/00000001546909506780000000-vrops-vmware_vcenter.pdxfixit.com.json
+	key:  vrops-vmware_vcenter.pdxfixit.com
+*/
+type spoolEntry struct {
+	path string
+	key  string
+}
+
+// list the spooled recordsets, oldest first
+func spooledEntries() (entries []spoolEntry, err error) {
+
+	files, err := ioutil.ReadDir(config.Hostdb.SpoolDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+
+		name := file.Name()
+		if file.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimSuffix(name, ".json"), "-", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		entries = append(entries, spoolEntry{
+			path: filepath.Join(config.Hostdb.SpoolDir, name),
+			key:  parts[1],
+		})
+
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].path < entries[j].path
+	})
+
+	return entries, nil
+
+}
+
+// remove any spooled recordsets for the same vcenter, now that newer data has been sent
+func discardSpooled(recordSet hostdb.RecordSet) (err error) {
+
+	entries, err := spooledEntries()
+	if err != nil {
+		return err
+	}
+
+	key := spoolKey(recordSet)
+	for _, entry := range entries {
+		if entry.key == key {
+			log.Infof("Discarding superseded %s from the spool.", entry.path)
+			if err := os.Remove(entry.path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+
+}
+
+// re-send spooled recordsets in order, skipping any superseded by a newer one for the same vcenter
+func replaySpool(ctx context.Context) (sent int, failed int, err error) {
+
+	entries, err := spooledEntries()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// find the newest entry for each key
+	newest := map[string]string{}
+	for _, entry := range entries {
+		newest[entry.key] = entry.path
+	}
+
+	for _, entry := range entries {
+
+		if newest[entry.key] != entry.path {
+			log.Infof("Discarding superseded %s from the spool.", entry.path)
+			if err := os.Remove(entry.path); err != nil {
+				return sent, failed, err
+			}
+			continue
+		}
+
+		recordSet, err := readRecordSetFile(entry.path)
+		if err != nil {
+			log.WithError(err).Errorf("Unable to read %s from the spool.", entry.path)
+			failed++
+			continue
+		}
+
+		log.Infof("Replaying %s (%d records)...", entry.path, len(recordSet.Records))
+
+		// a successful send also removes this entry from the spool
+		if err := (hostdbSink{}).Write(ctx, recordSet); err != nil {
+			log.WithError(err).Warnf("Unable to replay %s.", entry.path)
+			failed++
+			continue
+		}
+
+		sent++
+
+	}
+
+	return sent, failed, nil
+
+}
+
+// replay
+func replay(ctx context.Context, args []string) (err error) {
+
+	if len(args) > 0 {
+		return withExitCode(exitUsage, fmt.Errorf("unexpected arguments: %v", args))
+	}
+
+	if config.Hostdb.SpoolDir == "" {
+		return withExitCode(exitConfig, fmt.Errorf("hostdb.spool_dir is not configured"))
+	}
+
+	sent, failed, err := replaySpool(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Replayed %d recordsets from the spool, %d failed.", sent, failed)
+
+	if failed > 0 {
+		return withExitCode(exitSend, fmt.Errorf("%d recordsets could not be replayed", failed))
+	}
+
+	return nil
+
+}
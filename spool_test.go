@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/pdxfixit/hostdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplaySpool(t *testing.T) {
+
+	saved := config.Hostdb
+	defer func() { config.Hostdb = saved }()
+
+	dir, err := ioutil.TempDir("", "hostdb-collector-vrops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	var received []hostdb.RecordSet
+	up := false
+
+	// setup fake hostdb for test, which is down until told otherwise
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		recordSet := hostdb.RecordSet{}
+		if err := json.NewDecoder(r.Body).Decode(&recordSet); err != nil {
+			t.Error(err.Error())
+		}
+		received = append(received, recordSet)
+	}))
+	defer ts.Close()
+
+	config.Hostdb = hostdbConfig{URL: ts.URL, SpoolDir: dir}
+
+	older := hostdb.RecordSet{Type: "vrops-vmware", Timestamp: "2019-01-01 00:00:00", Context: map[string]interface{}{"vc_url": "vcenter01.test.pdxfixit.com"}}
+	newer := hostdb.RecordSet{Type: "vrops-vmware", Timestamp: "2019-01-02 00:00:00", Context: map[string]interface{}{"vc_url": "vcenter01.test.pdxfixit.com"}}
+	other := hostdb.RecordSet{Type: "vrops-vmware", Timestamp: "2019-01-01 00:00:00", Context: map[string]interface{}{"vc_url": "vcenter02.test.pdxfixit.com"}}
+
+	for _, recordSet := range []hostdb.RecordSet{older, other, newer} {
+		if _, err := spoolRecordSet(recordSet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := spooledEntries()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3, "spooled")
+	assert.Equal(t, "vrops-vmware_vcenter01.test.pdxfixit.com", entries[0].key, "oldest first")
+
+	// hostdb is down; the superseded entry is dropped, the others stay put
+	sent, failed, err := replaySpool(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, sent, "nothing sent while down")
+	assert.Equal(t, 2, failed, "both failed while down")
+
+	entries, err = spooledEntries()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2, "superseded entry discarded")
+	assert.Equal(t, exitSend, exitCode(replay(context.Background(), nil)), "the replay command fails")
+
+	// hostdb is back
+	up = true
+	sent, failed, err = replaySpool(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, sent, "sent")
+	assert.Equal(t, 0, failed, "failed")
+
+	if assert.Len(t, received, 2, "received") {
+		assert.Equal(t, "vcenter02.test.pdxfixit.com", received[0].Context["vc_url"], "in order")
+		assert.Equal(t, "2019-01-02 00:00:00", received[1].Timestamp, "newest for the vcenter")
+	}
+
+	entries, err = spooledEntries()
+	assert.NoError(t, err)
+	assert.Empty(t, entries, "spool emptied")
+
+}
+
+func TestDiscardSpooled(t *testing.T) {
+
+	saved := config.Hostdb
+	defer func() { config.Hostdb = saved }()
+
+	dir, err := ioutil.TempDir("", "hostdb-collector-vrops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	config.Hostdb.SpoolDir = dir
+
+	first := hostdb.RecordSet{Type: "vrops-vmware", Context: map[string]interface{}{"vc_url": "vcenter01.test.pdxfixit.com"}}
+	second := hostdb.RecordSet{Type: "vrops-vmware", Context: map[string]interface{}{"vc_url": "vcenter02.test.pdxfixit.com"}}
+
+	for _, recordSet := range []hostdb.RecordSet{first, second} {
+		if _, err := spoolRecordSet(recordSet); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assert.NoError(t, discardSpooled(first))
+
+	entries, err := spooledEntries()
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1, "one left") {
+		assert.Equal(t, spoolKey(second), entries[0].key, "the other vcenter remains")
+	}
+
+}
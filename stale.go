@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+)
+
+// what to do with a resource which vROps has lost track of, or isn't getting data for
+const (
+	staleKeep     = "keep"
+	staleFlag     = "flag"
+	staleDrop     = "drop"
+	staleSeparate = "separate"
+)
+
+// separated stale records have their own record type, e.g. vrops-vmware-virtualmachine-stale
+const staleTypeSuffix = "-stale"
+
+// why a resource looks to be gone, or no longer collected; empty when it's live
+// the adapter's own view of the resource is preferred, when vROps has one
+func staleReason(adapter vropsAdapterInstance, resource vropsResource) string {
+
+	var states []vropsResourceStatusState
+	for _, state := range resource.ResourceStatusStates {
+		if state.AdapterInstanceID == adapter.ID {
+			states = append(states, state)
+		}
+	}
+	if len(states) == 0 {
+		states = resource.ResourceStatusStates
+	}
+
+	for _, state := range states {
+		for _, s := range config.Collector.Stale.States {
+			if state.ResourceState == s {
+				return fmt.Sprintf("resource state %s", s)
+			}
+		}
+		for _, s := range config.Collector.Stale.Statuses {
+			if state.ResourceStatus == s {
+				return fmt.Sprintf("resource status %s", s)
+			}
+		}
+	}
+
+	return ""
+
+}
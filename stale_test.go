@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a virtual machine, with the status and state reported by each adapter monitoring it
+func testStaleResource(identifier string, states ...vropsResourceStatusState) vropsResource {
+
+	return vropsResource{
+		ResourceKey: vropsResourceKey{
+			Name:            identifier + ".pdxfixit.com",
+			AdapterKindKey:  "VMWARE",
+			ResourceKindKey: "VirtualMachine",
+		},
+		ResourceStatusStates: states,
+		Identifier:           identifier,
+	}
+
+}
+
+func TestStaleReason(t *testing.T) {
+
+	saved := config
+	defer func() { config = saved }()
+
+	config.Collector.Stale = staleConfig{
+		Policy:   staleFlag,
+		States:   []string{"NOT_EXISTING"},
+		Statuses: []string{"NO_DATA_RECEIVING"},
+	}
+
+	adapter := vropsAdapterInstance{ID: "adapter-a"}
+
+	assert.Empty(t, staleReason(adapter, testStaleResource("live", vropsResourceStatusState{AdapterInstanceID: "adapter-a", ResourceStatus: "DATA_RECEIVING", ResourceState: "STARTED"})), "live")
+	assert.Empty(t, staleReason(adapter, testStaleResource("unknown")), "nothing to go on")
+	assert.Equal(t, "resource state NOT_EXISTING", staleReason(adapter, testStaleResource("gone", vropsResourceStatusState{AdapterInstanceID: "adapter-a", ResourceStatus: "DATA_RECEIVING", ResourceState: "NOT_EXISTING"})), "gone")
+	assert.Equal(t, "resource status NO_DATA_RECEIVING", staleReason(adapter, testStaleResource("quiet", vropsResourceStatusState{AdapterInstanceID: "adapter-a", ResourceStatus: "NO_DATA_RECEIVING", ResourceState: "STARTED"})), "not receiving data")
+
+	// another adapter's view only counts when this adapter doesn't have one
+	assert.Empty(t, staleReason(adapter, testStaleResource("elsewhere",
+		vropsResourceStatusState{AdapterInstanceID: "adapter-a", ResourceStatus: "DATA_RECEIVING", ResourceState: "STARTED"},
+		vropsResourceStatusState{AdapterInstanceID: "adapter-b", ResourceStatus: "NO_DATA_RECEIVING", ResourceState: "NOT_EXISTING"},
+	)), "this adapter's view")
+	assert.NotEmpty(t, staleReason(adapter, testStaleResource("elsewhere",
+		vropsResourceStatusState{AdapterInstanceID: "adapter-b", ResourceStatus: "NO_DATA_RECEIVING", ResourceState: "NOT_EXISTING"},
+	)), "another adapter's view")
+
+}
+
+func TestGetResourcePropertiesStale(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := fmt.Fprint(w, `{"resourceId":"vm","property":[{"name":"summary|guest|hostName","value":"vm.pdxfixit.com"}]}`); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	saved := config
+	defer func() { config = saved }()
+
+	config.Vrops.Host = ts.URL
+	config.Vrops.ResourceKindKeys = []string{"VirtualMachine"}
+
+	adapter := vropsAdapterInstance{ID: "adapter-a"}
+	resources := []vropsResource{
+		testStaleResource("live", vropsResourceStatusState{AdapterInstanceID: "adapter-a", ResourceStatus: "DATA_RECEIVING", ResourceState: "STARTED"}),
+		testStaleResource("gone", vropsResourceStatusState{AdapterInstanceID: "adapter-a", ResourceStatus: "DATA_RECEIVING", ResourceState: "NOT_EXISTING"}),
+	}
+
+	for _, policy := range []string{staleKeep, staleFlag, staleDrop, staleSeparate} {
+
+		config.Collector.Stale = staleConfig{Policy: policy, States: []string{"NOT_EXISTING"}}
+		report := newRunReport("test-run").adapter(adapter)
+
+		collection := getResourceProperties(context.Background(), adapter, 0, resources, report, nil)
+
+		if policy == staleDrop {
+			assert.Len(t, collection, 1, "dropped")
+			assert.Equal(t, map[string]int{"VirtualMachine": 1}, report.Stale, "reported")
+			continue
+		}
+
+		if !assert.Len(t, collection, 2, policy) {
+			continue
+		}
+
+		data := vropsRecordData{}
+		assert.NoError(t, json.Unmarshal(collection[1].Data, &data))
+
+		switch policy {
+		case staleKeep:
+			assert.False(t, data.Stale, "kept as is")
+			assert.Empty(t, report.Stale, "not looked for")
+			assert.Equal(t, "vrops-vmware-virtualmachine", collection[1].Type, "record type")
+		case staleFlag:
+			assert.True(t, data.Stale, "flagged")
+			assert.Equal(t, "resource state NOT_EXISTING", data.StaleReason, "reason")
+			assert.Equal(t, "vrops-vmware-virtualmachine", collection[1].Type, "record type")
+		case staleSeparate:
+			assert.True(t, data.Stale, "flagged")
+			assert.Equal(t, "vrops-vmware-virtualmachine-stale", collection[1].Type, "a record type of its own")
+			assert.Equal(t, recordID("vrops-vmware-virtualmachine", "gone", nil), collection[1].ID, "the same id as when it was live")
+		}
+
+		live := vropsRecordData{}
+		assert.NoError(t, json.Unmarshal(collection[0].Data, &live))
+		assert.False(t, live.Stale, "live")
+		assert.Equal(t, "vrops-vmware-virtualmachine", collection[0].Type, "live record type")
+
+	}
+
+}
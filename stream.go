@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/pdxfixit/hostdb"
+)
+
+/*
+	type:      vrops-vmware
+	timestamp: 2019-01-01 00:00:00
+	context:   {}
+	committer: hostdb-collector-vrops
+*/
+type streamHeader struct {
+	Type      string                 `json:"type"`
+	Timestamp string                 `json:"timestamp"`
+	Context   map[string]interface{} `json:"context"`
+	Committer string                 `json:"committer"`
+}
+
+/*
+	context: {}
+	records: 12345
+*/
+type streamFooter struct {
+	Context map[string]interface{} `json:"context"`
+	Records int                    `json:"records"`
+}
+
+// each line of the stream holds exactly one of these
+type streamLine struct {
+	Header *streamHeader  `json:"header,omitempty"`
+	Record *hostdb.Record `json:"record,omitempty"`
+	Footer *streamFooter  `json:"footer,omitempty"`
+}
+
+// writes a recordset one record per line, as the records are collected, rather than all at once
+type recordStream struct {
+	encoder *json.Encoder
+	context map[string]interface{}
+	records int
+}
+
+// open the configured stream output; "-" is stdout, anything else is a file to append to
+func openStreamOutput(path string) (w io.WriteCloser, err error) {
+
+	if path == "-" {
+		return nopWriteCloser{output}, nil
+	}
+
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// start a stream, writing a header with the recordset context
+func newRecordStream(w io.Writer, recordSet hostdb.RecordSet) (stream *recordStream, err error) {
+
+	stream = &recordStream{
+		encoder: json.NewEncoder(w),
+		context: recordSet.Context,
+	}
+
+	if err := stream.encoder.Encode(streamLine{Header: &streamHeader{
+		Type:      recordSet.Type,
+		Timestamp: recordSet.Timestamp,
+		Context:   recordSet.Context,
+		Committer: recordSet.Committer,
+	}}); err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+
+}
+
+// write out some records, one per line
+func (s *recordStream) Write(records []hostdb.Record) (err error) {
+
+	for i := range records {
+		if err := s.encoder.Encode(streamLine{Record: &records[i]}); err != nil {
+			return err
+		}
+		s.records++
+	}
+
+	return nil
+
+}
+
+// finish the stream, writing a footer with the number of records
+func (s *recordStream) Close() (err error) {
+
+	return s.encoder.Encode(streamLine{Footer: &streamFooter{
+		Context: s.context,
+		Records: s.records,
+	}})
+
+}
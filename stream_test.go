@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pdxfixit/hostdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordStream(t *testing.T) {
+
+	buf := &bytes.Buffer{}
+
+	recordSet := hostdb.RecordSet{
+		Type:      "vrops-vmware",
+		Timestamp: "2019-01-01 00:00:00",
+		Context:   map[string]interface{}{"vc_url": "vcenter.test.pdxfixit.com"},
+		Committer: "hostdb-collector-vrops",
+	}
+
+	stream, err := newRecordStream(buf, recordSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, stream.Write([]hostdb.Record{
+		{Type: "vrops-vmware-virtualmachine", Hostname: "foo.pdxfixit.com", Data: []byte("{}")},
+		{Type: "vrops-vmware-virtualmachine", Hostname: "bar.pdxfixit.com", Data: []byte("{}")},
+	}))
+	assert.NoError(t, stream.Write([]hostdb.Record{
+		{Type: "vrops-vmware-hostsystem", Hostname: "esx01.pdxfixit.com", Data: []byte("{}")},
+	}))
+	assert.NoError(t, stream.Close())
+
+	var lines []streamLine
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		line := streamLine{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+
+	assert.Len(t, lines, 5, "header, three records, footer")
+
+	if assert.NotNil(t, lines[0].Header, "header") {
+		assert.Equal(t, "vrops-vmware", lines[0].Header.Type, "header type")
+		assert.Equal(t, "vcenter.test.pdxfixit.com", lines[0].Header.Context["vc_url"], "header context")
+	}
+
+	for _, line := range lines[1:4] {
+		assert.NotNil(t, line.Record, "record")
+	}
+	assert.Equal(t, "bar.pdxfixit.com", lines[2].Record.Hostname, "record hostname")
+
+	if assert.NotNil(t, lines[4].Footer, "footer") {
+		assert.Equal(t, 3, lines[4].Footer.Records, "footer record count")
+		assert.Equal(t, "vcenter.test.pdxfixit.com", lines[4].Footer.Context["vc_url"], "footer context")
+	}
+
+}
+
+func TestOpenStreamOutput(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "hostdb-collector-vrops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	path := filepath.Join(dir, "stream.ndjson")
+
+	// each open appends
+	for i := 0; i < 2; i++ {
+		w, err := openStreamOutput(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("{}\n")); err != nil {
+			t.Error(err)
+		}
+		assert.NoError(t, w.Close())
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "{}\n{}\n", string(data), "appended")
+
+	// stdout
+	buf := &bytes.Buffer{}
+	output = buf
+	defer func() { output = os.Stdout }()
+
+	w, err := openStreamOutput("-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("{}\n")); err != nil {
+		t.Error(err)
+	}
+	assert.NoError(t, w.Close())
+	assert.Equal(t, "{}\n", buf.String(), "stdout")
+
+}
@@ -1,28 +1,204 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 /*
-	debug:       false
-	sample_data: false
+	context:         { site: pdx, region: us-west, environment: prod }
+	debug:           false
+	diff:            false
+	duplicates:      mark
+	exclude:         [ vcenter-lab.pdxfixit.com ]
+	include:         [ *.prod.pdxfixit.com ]
+	log_format:      json
+	log_level:       info
+	record_id:       identifier
+	report:          /var/lib/hostdb-collector-vrops/report.json
+	request_timeout: 5m
+	run_timeout:     0
+	sample_data:     false
+	sinks:           []
+	snapshot_dir:    /var/lib/hostdb-collector-vrops
+	stale:           {}
+	stream:          -
+	timestamp:       collected
 */
 type collectorConfig struct {
-	Debug      bool `mapstructure:"debug"`
-	SampleData bool `mapstructure:"sample_data"`
+	Context        map[string]string `mapstructure:"context"`
+	Debug          bool              `mapstructure:"debug"`
+	Diff           bool              `mapstructure:"diff"`
+	Duplicates     string            `mapstructure:"duplicates"`
+	Exclude        []string          `mapstructure:"exclude"`
+	Include        []string          `mapstructure:"include"`
+	LogFormat      string            `mapstructure:"log_format"`
+	LogLevel       string            `mapstructure:"log_level"`
+	RecordID       string            `mapstructure:"record_id"`
+	Report         string            `mapstructure:"report"`
+	RequestTimeout time.Duration     `mapstructure:"request_timeout"`
+	RunTimeout     time.Duration     `mapstructure:"run_timeout"`
+	SampleData     bool              `mapstructure:"sample_data"`
+	Sinks          []sinkConfig      `mapstructure:"sinks"`
+	SnapshotDir    string            `mapstructure:"snapshot_dir"`
+	Stale          staleConfig       `mapstructure:"stale"`
+	Stream         string            `mapstructure:"stream"`
+	Timestamp      string            `mapstructure:"timestamp"`
+}
+
+/*
+	policy:   flag
+	states:   [ NOT_EXISTING ]
+	statuses: [ NO_DATA_RECEIVING ]
+*/
+type staleConfig struct {
+	Policy   string   `mapstructure:"policy"`
+	States   []string `mapstructure:"states"`
+	Statuses []string `mapstructure:"statuses"`
+}
+
+/*
+	include:  [ vcenter01.pdxfixit.com ]
+	schedule: @every 1h
+*/
+type adapterScheduleConfig struct {
+	Include  []string `mapstructure:"include"`
+	Schedule string   `mapstructure:"schedule"`
+}
+
+/*
+	adapters:         []
+	run_on_start:     true
+	schedule:         @every 4h
+	shutdown:         finish
+	shutdown_timeout: 5m
+*/
+type daemonConfig struct {
+	Adapters        []adapterScheduleConfig `mapstructure:"adapters"`
+	RunOnStart      bool                    `mapstructure:"run_on_start"`
+	Schedule        string                  `mapstructure:"schedule"`
+	Shutdown        string                  `mapstructure:"shutdown"`
+	ShutdownTimeout time.Duration           `mapstructure:"shutdown_timeout"`
 }
 
 /*
 	collector: {}
+	daemon:    {}
+	health:    {}
+	hostdb:    {}
+	http:      {}
+	metrics:   {}
+	secrets:   {}
 	vrops:     {}
 */
 type globalConfig struct {
 	Collector collectorConfig `mapstructure:"collector"`
+	Daemon    daemonConfig    `mapstructure:"daemon"`
+	Health    healthConfig    `mapstructure:"health"`
+	Hostdb    hostdbConfig    `mapstructure:"hostdb"`
+	HTTP      httpConfig      `mapstructure:"http"`
+	Metrics   metricsConfig   `mapstructure:"metrics"`
+	Secrets   secretsConfig   `mapstructure:"secrets"`
 	Vrops     vropsConfig     `mapstructure:"vrops"`
 }
 
+/*
+	max_heartbeat_age:  30m
+	message:            Trust Established.
+	min_resources:      1
+	min_resource_ratio: 0.5
+*/
+type healthConfig struct {
+	MaxHeartbeatAge  time.Duration `mapstructure:"max_heartbeat_age"`
+	Message          string        `mapstructure:"message"`
+	MinResources     int           `mapstructure:"min_resources"`
+	MinResourceRatio float64       `mapstructure:"min_resource_ratio"`
+}
+
+/*
+	chunk_bytes:   10485760
+	chunk_records: 5000
+	gzip:          true
+	pass:          password
+	pass_file:     /var/run/secrets/hostdb/pass
+	pass_secret:   hostdb-collector-vrops/hostdb#pass
+	spool_dir:     /var/lib/hostdb-collector-vrops/spool
+	url:           https://hostdb.pdxfixit.com/v0/records/
+	user:          username
+*/
+type hostdbConfig struct {
+	ChunkBytes   int    `mapstructure:"chunk_bytes"`
+	ChunkRecords int    `mapstructure:"chunk_records"`
+	Gzip         bool   `mapstructure:"gzip"`
+	Pass         string `mapstructure:"pass"`
+	PassFile     string `mapstructure:"pass_file"`
+	PassSecret   string `mapstructure:"pass_secret"`
+	SpoolDir     string `mapstructure:"spool_dir"`
+	URL          string `mapstructure:"url"`
+	User         string `mapstructure:"user"`
+}
+
+/*
+	http2:                   true
+	idle_conn_timeout:       90s
+	max_idle_conns_per_host: 10
+	proxy:                   http://proxy.pdxfixit.com:3128
+*/
+type httpConfig struct {
+	HTTP2               bool          `mapstructure:"http2"`
+	IdleConnTimeout     time.Duration `mapstructure:"idle_conn_timeout"`
+	MaxIdleConnsPerHost int           `mapstructure:"max_idle_conns_per_host"`
+	Proxy               string        `mapstructure:"proxy"`
+}
+
+/*
+	job:         hostdb-collector-vrops
+	listen:      :9090
+	pushgateway: https://pushgateway.pdxfixit.com
+*/
+type metricsConfig struct {
+	Job         string `mapstructure:"job"`
+	Listen      string `mapstructure:"listen"`
+	Pushgateway string `mapstructure:"pushgateway"`
+}
+
+/*
+	provider: vault
+	vault:    {}
+*/
+type secretsConfig struct {
+	Provider string      `mapstructure:"provider"`
+	Vault    vaultConfig `mapstructure:"vault"`
+}
+
+/*
+	mount:      secret
+	token:      s.1234567890abcdef
+	token_file: /var/run/secrets/vault/token
+	url:        https://vault.pdxfixit.com
+*/
+type vaultConfig struct {
+	Mount     string `mapstructure:"mount"`
+	Token     string `mapstructure:"token"`
+	TokenFile string `mapstructure:"token_file"`
+	URL       string `mapstructure:"url"`
+}
+
+/*
+	type:    webhook
+	path:    /var/lib/hostdb-collector-vrops/archive
+	url:     https://example.pdxfixit.com/hook
+	headers: {}
+*/
+type sinkConfig struct {
+	Type    string            `mapstructure:"type"`
+	Path    string            `mapstructure:"path"`
+	URL     string            `mapstructure:"url"`
+	Headers map[string]string `mapstructure:"headers"`
+}
+
 /*
 	resourceKey:                {}
 	description:                fancy
@@ -54,6 +230,19 @@ type vropsAdapterInstance struct {
 	ID                         string           `json:"id"`
 }
 
+// the vCenter URL, if the adapter has one
+func (obj vropsAdapterInstance) VcURL() string {
+
+	for _, identifier := range obj.ResourceKey.ResourceIdentifiers {
+		if identifier.IdentifierType.Name == "VCURL" {
+			return identifier.Value
+		}
+	}
+
+	return ""
+
+}
+
 /*
 	adapterInstancesInfoDto: []
 */
@@ -61,22 +250,18 @@ type vropsAdapterList struct {
 	Instances []vropsAdapterInstance `json:"adapterInstancesInfoDto"`
 }
 
-func (obj *vropsAdapterList) LoadFrom(url string) (err error) {
+func (obj *vropsAdapterList) LoadFrom(ctx context.Context, url string) (err error) {
 
-	if config.Collector.Debug {
-		log.Println(fmt.Sprintf(
-			"Populating vropsAdapterList from %s.",
-			url,
-		))
-	}
+	log.Debugf(
+		"Populating vropsAdapterList from %s.",
+		url,
+	)
 
-	if err := requestToStruct(url, &obj); err != nil {
+	if err := requestToStruct(ctx, url, &obj); err != nil {
 		return err
 	}
 
-	if config.Collector.Debug {
-		log.Println(fmt.Sprintf("%v", *obj))
-	}
+	log.Debugf("%v", *obj)
 
 	return nil
 
@@ -93,22 +278,18 @@ type vropsAdapterResources struct {
 	ResourceList []vropsResource `json:"resourceList"`
 }
 
-func (obj *vropsAdapterResources) LoadFrom(url string) (err error) {
+func (obj *vropsAdapterResources) LoadFrom(ctx context.Context, url string) (err error) {
 
-	if config.Collector.Debug {
-		log.Println(fmt.Sprintf(
-			"Populating vropsAdapterResources from %s.",
-			url,
-		))
-	}
+	log.Debugf(
+		"Populating vropsAdapterResources from %s.",
+		url,
+	)
 
-	if err := requestToStruct(url, &obj); err != nil {
+	if err := requestToStruct(ctx, url, &obj); err != nil {
 		return err
 	}
 
-	if config.Collector.Debug {
-		log.Println(fmt.Sprintf("%v", *obj))
-	}
+	log.Debugf("%v", *obj)
 
 	return nil
 
@@ -129,13 +310,19 @@ type vropsBadge struct {
 	host:             https://vrops.pdxfixit.com
 	pageSize:         1000
 	pass:             password
+	pass_file:        /var/run/secrets/vrops/pass
+	pass_secret:      hostdb-collector-vrops/vrops#pass
 	resourceKindKeys: [ ClusterComputeResource Datastore VirtualMachine ]
+	stat_timestamps:  false
 */
 type vropsConfig struct {
 	Host             string   `mapstructure:"host"`
 	PageSize         int      `mapstructure:"pageSize"`
 	Pass             string   `mapstructure:"pass"`
+	PassFile         string   `mapstructure:"pass_file"`
+	PassSecret       string   `mapstructure:"pass_secret"`
 	ResourceKindKeys []string `mapstructure:"resourceKindKeys"`
+	StatTimestamps   bool     `mapstructure:"stat_timestamps"`
 	User             string   `mapstructure:"user"`
 }
 
@@ -237,22 +424,33 @@ type vropsResourceProperties struct {
 	Property   []vropsProperty `json:"property"`
 }
 
-func (obj *vropsResourceProperties) LoadFrom(url string) (err error) {
+/*
+	resourceId:        2fb64df9-7665-4bec-9d53-e49c5a71563a
+	adapterInstanceId: 15a4759d-0b2f-4432-bbfd-9a6f4cfab7e4
+	stale:             true
+	staleReason:       resource state NOT_EXISTING
+	property:          []
+*/
+type vropsRecordData struct {
+	ResourceID        string          `json:"resourceId"`
+	AdapterInstanceID string          `json:"adapterInstanceId"`
+	Stale             bool            `json:"stale,omitempty"`
+	StaleReason       string          `json:"staleReason,omitempty"`
+	Property          []vropsProperty `json:"property"`
+}
 
-	if config.Collector.Debug {
-		log.Println(fmt.Sprintf(
-			"Populating vropsResourceProperties from %s.",
-			url,
-		))
-	}
+func (obj *vropsResourceProperties) LoadFrom(ctx context.Context, url string) (err error) {
 
-	if err := requestToStruct(url, &obj); err != nil {
+	log.Debugf(
+		"Populating vropsResourceProperties from %s.",
+		url,
+	)
+
+	if err := requestToStruct(ctx, url, &obj); err != nil {
 		return err
 	}
 
-	if config.Collector.Debug {
-		log.Println(fmt.Sprintf("%v", *obj))
-	}
+	log.Debugf("%v", *obj)
 
 	return nil
 
@@ -283,3 +481,61 @@ type vropsSessionToken struct {
 	ExpiresAt string   `json:"expiresAt"`
 	Roles     []string `json:"roles"`
 }
+
+/*
+	values: [ { resourceId: 2fb64df9-7665-4bec-9d53-e49c5a71563a, stat-list: {} } ]
+*/
+type vropsLatestStats struct {
+	Values []vropsResourceStats `json:"values"`
+}
+
+/*
+	resourceId: 2fb64df9-7665-4bec-9d53-e49c5a71563a
+	stat-list:  { stat: [] }
+*/
+type vropsResourceStats struct {
+	ResourceID string        `json:"resourceId"`
+	StatList   vropsStatList `json:"stat-list"`
+}
+
+/*
+	stat: []
+*/
+type vropsStatList struct {
+	Stat []vropsStat `json:"stat"`
+}
+
+/*
+	timestamps: [ 1546909506780 ]
+	statKey:    { key: cpu|usage_average }
+	data:       [ 1.5 ]
+*/
+type vropsStat struct {
+	Timestamps []int        `json:"timestamps"`
+	StatKey    vropsStatKey `json:"statKey"`
+	Data       []float64    `json:"data"`
+}
+
+/*
+	key: cpu|usage_average
+*/
+type vropsStatKey struct {
+	Key string `json:"key"`
+}
+
+func (obj *vropsLatestStats) LoadFrom(ctx context.Context, url string) (err error) {
+
+	log.Debugf(
+		"Populating vropsLatestStats from %s.",
+		url,
+	)
+
+	if err := requestToStruct(ctx, url, &obj); err != nil {
+		return err
+	}
+
+	log.Debugf("%v", *obj)
+
+	return nil
+
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -22,7 +23,7 @@ func TestVropsAdapterList_LoadFrom(t *testing.T) {
 
 	adapterList := vropsAdapterList{}
 
-	if err := adapterList.LoadFrom(ts.URL); err != nil {
+	if err := adapterList.LoadFrom(context.Background(), ts.URL); err != nil {
 		t.Errorf("%v", err)
 	}
 
@@ -68,7 +69,7 @@ func TestVropsAdapterResources_LoadFrom(t *testing.T) {
 
 	adapterResources := vropsAdapterResources{}
 
-	if err := adapterResources.LoadFrom(ts.URL); err != nil {
+	if err := adapterResources.LoadFrom(context.Background(), ts.URL); err != nil {
 		t.Errorf("%v", err)
 	}
 
@@ -124,7 +125,7 @@ func TestVropsResourceProperties_LoadFrom(t *testing.T) {
 
 	resourceProperties := vropsResourceProperties{}
 
-	if err := resourceProperties.LoadFrom(ts.URL); err != nil {
+	if err := resourceProperties.LoadFrom(context.Background(), ts.URL); err != nil {
 		t.Errorf("%v", err)
 	}
 
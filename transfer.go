@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// bytes moved over http, both on the wire and uncompressed
+type byteCounters struct {
+	sent         int64
+	sentWire     int64
+	received     int64
+	receivedWire int64
+}
+
+// totals since the last reset, e.g. per adapter
+var transferred = &byteCounters{}
+
+func (c *byteCounters) String() string {
+
+	return fmt.Sprintf(
+		"sent %d bytes (%d on the wire), received %d bytes (%d on the wire)",
+		atomic.LoadInt64(&c.sent),
+		atomic.LoadInt64(&c.sentWire),
+		atomic.LoadInt64(&c.received),
+		atomic.LoadInt64(&c.receivedWire),
+	)
+
+}
+
+// zero the counters, returning what they were
+func (c *byteCounters) Reset() (previous byteCounters) {
+
+	return byteCounters{
+		sent:         atomic.SwapInt64(&c.sent, 0),
+		sentWire:     atomic.SwapInt64(&c.sentWire, 0),
+		received:     atomic.SwapInt64(&c.received, 0),
+		receivedWire: atomic.SwapInt64(&c.receivedWire, 0),
+	}
+
+}
+
+// counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	count  *int64
+}
+
+func (r countingReader) Read(p []byte) (n int, err error) {
+
+	n, err = r.reader.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+
+	return n, err
+
+}
+
+// read a request body into memory, gzipping it if need be, and counting the bytes before and after
+// a bytes.Reader lets net/http set the Content-Length, and rewind the body for redirects and retries
+func bufferBody(body io.Reader, compress bool) (buffered *bytes.Reader, err error) {
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&transferred.sent, int64(len(data)))
+
+	if compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+	atomic.AddInt64(&transferred.sentWire, int64(len(data)))
+
+	return bytes.NewReader(data), nil
+
+}
+
+// read a response body, gunzipping it if need be, and counting the bytes before and after
+func readBody(body io.Reader, encoding string) (data []byte, err error) {
+
+	wire := countingReader{body, &transferred.receivedWire}
+
+	if encoding != "gzip" {
+		data, err = ioutil.ReadAll(wire)
+		atomic.AddInt64(&transferred.received, int64(len(data)))
+		return data, err
+	}
+
+	zr, err := gzip.NewReader(wire)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&transferred.received, int64(len(data)))
+
+	return data, zr.Close()
+
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferBody(t *testing.T) {
+
+	transferred.Reset()
+
+	payload := strings.Repeat("hostdb-collector-vrops ", 100)
+
+	// plain
+	plain, err := bufferBody(strings.NewReader(payload), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(len(payload)), plain.Size(), "plain length")
+
+	counts := transferred.Reset()
+	assert.Equal(t, int64(len(payload)), counts.sent, "plain bytes sent")
+	assert.Equal(t, int64(len(payload)), counts.sentWire, "plain bytes sent on the wire")
+
+	// gzipped
+	compressed, err := bufferBody(strings.NewReader(payload), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire := compressed.Size()
+
+	zr, err := gzip.NewReader(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, payload, string(data), "round trip")
+
+	counts = transferred.Reset()
+	assert.Equal(t, int64(len(payload)), counts.sent, "uncompressed bytes sent")
+	assert.Equal(t, wire, counts.sentWire, "compressed bytes sent")
+	assert.True(t, counts.sentWire < counts.sent, "compressed")
+
+}
+
+func TestReadBody(t *testing.T) {
+
+	transferred.Reset()
+
+	payload := strings.Repeat("hostdb-collector-vrops ", 100)
+
+	// plain
+	data, err := readBody(strings.NewReader(payload), "")
+	assert.NoError(t, err)
+	assert.Equal(t, payload, string(data), "plain body")
+
+	counts := transferred.Reset()
+	assert.Equal(t, int64(len(payload)), counts.received, "plain bytes")
+	assert.Equal(t, int64(len(payload)), counts.receivedWire, "plain bytes on the wire")
+
+	// gzipped
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wire := buf.Len()
+
+	data, err = readBody(&buf, "gzip")
+	assert.NoError(t, err)
+	assert.Equal(t, payload, string(data), "gzipped body")
+
+	counts = transferred.Reset()
+	assert.Equal(t, int64(len(payload)), counts.received, "gzipped bytes")
+	assert.Equal(t, int64(wire), counts.receivedWire, "gzipped bytes on the wire")
+
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// shared by every request to vROps and HostDB, so that connections are reused
+var httpClient = &http.Client{}
+
+// build the transport described by the http section of config
+func newTransport(c httpConfig) (transport *http.Transport, err error) {
+
+	// an explicit proxy, otherwise the usual HTTPS_PROXY, HTTP_PROXY and NO_PROXY variables
+	proxy := http.ProxyFromEnvironment
+	if c.Proxy != "" {
+		proxyURL, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	transport = &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     c.HTTP2,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+		IdleConnTimeout:       c.IdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+
+		// INSECURE
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+
+	// a non-nil, empty map turns http/2 off
+	if !c.HTTP2 {
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return transport, nil
+
+}
+
+// replace the shared client's transport, per config
+// the default transport is replaced too, so anything using the default client, e.g. the hostdb package, shares it
+func configureTransport() error {
+
+	transport, err := newTransport(config.HTTP)
+	if err != nil {
+		return err
+	}
+
+	// don't leave the previous transport's connections lying around
+	if previous, ok := httpClient.Transport.(*http.Transport); ok {
+		previous.CloseIdleConnections()
+	}
+
+	httpClient.Transport = transport
+	http.DefaultTransport = transport
+
+	return nil
+
+}
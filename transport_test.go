@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTransport(t *testing.T) {
+
+	transport, err := newTransport(httpConfig{
+		HTTP2:               true,
+		IdleConnTimeout:     time.Minute,
+		MaxIdleConnsPerHost: 10,
+		Proxy:               "http://proxy.test.pdxfixit.com:3128",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, transport.ForceAttemptHTTP2, "http/2")
+	assert.Nil(t, transport.TLSNextProto, "http/2 left on")
+	assert.Equal(t, time.Minute, transport.IdleConnTimeout, "idle timeout")
+	assert.Equal(t, 10, transport.MaxIdleConnsPerHost, "idle conns per host")
+	assert.True(t, transport.TLSClientConfig.InsecureSkipVerify, "still insecure")
+
+	req, err := http.NewRequest("GET", "https://vrops.test.pdxfixit.com/suite-api/api/adapters", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := transport.Proxy(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "proxy.test.pdxfixit.com:3128", proxy.Host, "proxy from config")
+
+	transport, err = newTransport(httpConfig{HTTP2: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.False(t, transport.ForceAttemptHTTP2, "no http/2")
+	assert.NotNil(t, transport.TLSNextProto, "http/2 turned off")
+
+	_, err = newTransport(httpConfig{Proxy: "http://[::1"})
+	assert.Error(t, err, "invalid proxy")
+
+}
+
+func TestTransportReuse(t *testing.T) {
+
+	// count the connections made to the server
+	var connections int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := fmt.Fprint(w, "{}"); err != nil {
+			t.Error(err)
+		}
+	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	assert.NoError(t, configureTransport())
+	assert.Equal(t, http.DefaultTransport, httpClient.Transport, "shared with the default client")
+
+	for i := 0; i < 3; i++ {
+		_, err := httpRequest(context.Background(), "GET", ts.URL, nil, vropsSessionHeaders)
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connections), "one connection, kept alive")
+
+}
@@ -1,19 +1,60 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/pdxfixit/hostdb"
+	log "github.com/sirupsen/logrus"
 )
 
+// the most resources vrops will return in a page
+const maxPageSize = 10000
+
+// the resource kinds of the vmware adapter
+var resourceKinds = []string{
+	"ClusterComputeResource",
+	"ComputeResource",
+	"CustomDatacenter",
+	"Datacenter",
+	"Datastore",
+	"DatastoreFolder",
+	"DistributedVirtualPortgroup",
+	"Folder",
+	"HostFolder",
+	"HostSystem",
+	"NetworkFolder",
+	"ResourcePool",
+	"StoragePod",
+	"VirtualMachine",
+	"VM Entity Status",
+	"VMFolder",
+	"VMwareAdapter Instance",
+	"VmwareDistributedVirtualSwitch",
+	"vSphere World",
+}
+
+func knownResourceKind(kind string) bool {
+
+	for _, known := range resourceKinds {
+		if known == kind {
+			return true
+		}
+	}
+
+	return false
+
+}
+
 // using an adapter ID, get the related resources
-func getAdapterResources(adapterID string, currentPage int) (resources vropsAdapterResources, err error) {
+func getAdapterResources(ctx context.Context, adapterID string, currentPage int) (resources vropsAdapterResources, err error) {
 
 	if err := resources.LoadFrom(
+		ctx,
 		fmt.Sprintf(
 			"%s/suite-api/api/adapters/%s/resources?compression=enabled&page=%d&amp;pageSize=%d",
 			config.Vrops.Host,
@@ -29,22 +70,27 @@ func getAdapterResources(adapterID string, currentPage int) (resources vropsAdap
 
 }
 
-// get the properties for a slice of resources, return a slice of HostDB records
-func getResourceProperties(resources []vropsResource) (collection []hostdb.Record) {
+// get the properties for a slice of the adapter's resources, from the given page of them, return a slice of HostDB records
+// anything skipped, failed or duplicated is noted in the report, if there is one
+// resources already collected in this run are marked or dropped, when there's an index of them
+func getResourceProperties(ctx context.Context, adapter vropsAdapterInstance, page int, resources []vropsResource, report *adapterReport, duplicates *duplicateIndex) (collection []hostdb.Record) {
 
 	// for each of the resources
 	for i, resource := range resources {
 
-		if config.Collector.Debug {
-			log.Println(fmt.Sprintf(
-				"Resource %d/%d (%s)...",
-				i+1,
-				len(resources),
-				resource.ResourceKey.ResourceKindKey,
-			))
-			log.Println(fmt.Sprintf("%v", resource))
+		// once cancelled, every request would fail; the caller will notice
+		if ctx.Err() != nil {
+			return
 		}
 
+		log.Debugf(
+			"Resource %d/%d (%s)...",
+			i+1,
+			len(resources),
+			resource.ResourceKey.ResourceKindKey,
+		)
+		log.Debugf("%v", resource)
+
 		// if this is not a resource listed in the config, skip it
 		wanted := false
 		for _, kind := range config.Vrops.ResourceKindKeys {
@@ -55,34 +101,71 @@ func getResourceProperties(resources []vropsResource) (collection []hostdb.Recor
 		}
 
 		if !wanted {
-			log.Println("Skipping!")
+			log.Debugf("Skipping the resource %s (%s).", resource.Identifier, resource.ResourceKey.ResourceKindKey)
+			report.skipResource(resource)
 			continue
 		}
 
+		// ghosts: resources vROps has lost track of, or isn't getting data for
+		// even when they're kept as is, a ghost mustn't be taken for the original of its live copy
+		ghost := staleReason(adapter, resource)
+		stale := ""
+		if config.Collector.Stale.Policy != "" && config.Collector.Stale.Policy != staleKeep {
+			stale = ghost
+		}
+		if stale != "" {
+			report.staleResource(resource)
+			if config.Collector.Stale.Policy == staleDrop {
+				log.Debugf("Dropping the stale resource %s (%s).", resource.Identifier, stale)
+				continue
+			}
+		}
+
 		vropsResourceProperties := vropsResourceProperties{}
 
 		// get the properties for this resource
 		if err := vropsResourceProperties.LoadFrom(
+			ctx,
 			fmt.Sprintf(
 				"%s/suite-api/api/resources/%s/properties?compression=enabled",
 				config.Vrops.Host,
 				resource.Identifier,
 			),
 		); err != nil {
-			log.Println(err)
+			log.WithError(err).Warnf("Unable to get the properties for the resource %s.", resource.Identifier)
+			report.failResource(resource, err)
 			continue
 		}
 
-		if config.Collector.Debug {
-			log.Println(fmt.Sprintf("Found %d properties for the resource %s.", len(vropsResourceProperties.Property), resource.Identifier))
+		log.Debugf("Found %d properties for the resource %s.", len(vropsResourceProperties.Property), resource.Identifier)
+
+		// when the collector collected it, and when vROps did: its latest stats if asked for, or else the adapter's last collection
+		collected := time.Now().UTC()
+		vropsTimestamp := vropsTime(adapter.LastCollected)
+		var statsTimestamp time.Time
+		if config.Vrops.StatTimestamps {
+			latest, err := latestStatTime(ctx, resource.Identifier)
+			if err != nil {
+				log.WithError(err).Warnf("Unable to get the latest stats for the resource %s.", resource.Identifier)
+			} else if !latest.IsZero() {
+				statsTimestamp = latest
+				vropsTimestamp = latest
+			}
 		}
 
 		// TODO: validate data
 
-		// marshal into json
-		jsonPayload, err := json.Marshal(vropsResourceProperties)
+		// marshal into json, along with where it came from
+		jsonPayload, err := json.Marshal(vropsRecordData{
+			ResourceID:        resource.Identifier,
+			AdapterInstanceID: adapter.ID,
+			Stale:             stale != "",
+			StaleReason:       stale,
+			Property:          vropsResourceProperties.Property,
+		})
 		if err != nil {
-			log.Println(err)
+			log.WithError(err).Errorf("Unable to encode the properties for the resource %s.", resource.Identifier)
+			report.failResource(resource, err)
 			continue
 		}
 
@@ -125,17 +208,39 @@ func getResourceProperties(resources []vropsResource) (collection []hostdb.Recor
 
 		// stow the whole thing in hostdb
 		record := hostdb.Record{
-			ID:        "",
+			ID:        recordID(recordType, resource.Identifier, vropsResourceProperties.Property),
 			Type:      recordType,
 			Hostname:  hostname,
 			IP:        ip,
-			Timestamp: time.Now().UTC().Format("2006-01-02 15:04:05"),
+			Timestamp: primaryTimestamp(collected, vropsTimestamp),
 			Committer: "hostdb-collector-vrops",
-			Context:   nil,
+			Context:   resourceContext(adapter, page, resource),
 			Data:      jsonPayload,
 			Hash:      "",
 		}
 
+		record.Context["collected"] = collected.Format(time.RFC3339)
+		if !statsTimestamp.IsZero() {
+			record.Context["vrops_timestamp"] = statsTimestamp.Format(time.RFC3339)
+		}
+
+		// the same machine, already collected through another vCenter or vROps
+		if original, match, found := duplicates.check(adapter, resource, recordType, vropsResourceProperties.Property, ghost != ""); found {
+			report.duplicateResource(resource, original, match)
+			if config.Collector.Duplicates == duplicatesDrop {
+				log.Warnf("Dropping the resource %s, already collected through the adapter %s as %s (%s).", resource.Identifier, original.AdapterID, original.Identifier, match)
+				continue
+			}
+			log.Warnf("Marking the resource %s, already collected through the adapter %s as %s (%s).", resource.Identifier, original.AdapterID, original.Identifier, match)
+			record.Context["duplicate_of"] = original
+			record.Context["duplicate_match"] = match
+		}
+
+		// kept apart from the live records of the same kind
+		if stale != "" && config.Collector.Stale.Policy == staleSeparate {
+			record.Type += staleTypeSuffix
+		}
+
 		collection = append(collection, record)
 
 	}
@@ -144,31 +249,105 @@ func getResourceProperties(resources []vropsResource) (collection []hostdb.Recor
 
 }
 
+// where a record came from, so that it can be traced back to its source object
+func resourceContext(adapter vropsAdapterInstance, page int, resource vropsResource) map[string]interface{} {
+
+	fields := map[string]interface{}{
+		"adapter_id":    adapter.ID,
+		"page":          page,
+		"resource_id":   resource.Identifier,
+		"resource_kind": resource.ResourceKey.ResourceKindKey,
+	}
+
+	if host := vropsHost(); host != "" {
+		fields["vrops_host"] = host
+	}
+
+	// vROps doesn't timestamp properties individually; they're refreshed each time the adapter collects
+	if lastCollected := vropsTime(adapter.LastCollected); !lastCollected.IsZero() {
+		fields["properties_collected"] = lastCollected.Format(time.RFC3339)
+	}
+
+	return fields
+
+}
+
+// when vROps last received data for a resource, from the timestamps of its latest stats
+func latestStatTime(ctx context.Context, identifier string) (latest time.Time, err error) {
+
+	stats := vropsLatestStats{}
+	if err := stats.LoadFrom(
+		ctx,
+		fmt.Sprintf(
+			"%s/suite-api/api/resources/%s/stats/latest?compression=enabled",
+			config.Vrops.Host,
+			identifier,
+		),
+	); err != nil {
+		return time.Time{}, err
+	}
+
+	for _, values := range stats.Values {
+		for _, stat := range values.StatList.Stat {
+			for _, timestamp := range stat.Timestamps {
+				if t := vropsTime(timestamp); t.After(latest) {
+					latest = t
+				}
+			}
+		}
+	}
+
+	return latest, nil
+
+}
+
+// the host name of the vROps being collected from
+func vropsHost() string {
+
+	vropsURL, err := url.Parse(config.Vrops.Host)
+	if err != nil {
+		return ""
+	}
+
+	return vropsURL.Host
+
+}
+
 // get a session token from vrops
-func getSessionToken() string {
+func getSessionToken(ctx context.Context) (token string, err error) {
 
-	log.Println(fmt.Sprintf("Trying %s...", config.Vrops.Host))
+	// read the password each time, in case it's been rotated
+	pass, err := vropsPass(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	log.Infof("Trying %s...", config.Vrops.Host)
 	session, err := httpRequest(
+		ctx,
 		"POST",
 		fmt.Sprintf("%s/suite-api/api/auth/token/acquire", config.Vrops.Host),
-		strings.NewReader(fmt.Sprintf("{\"username\":\"%s@pdxfixit.com\",\"password\":\"%s\"}", config.Vrops.User, config.Vrops.Pass)),
-		vropsSessionHeaders,
+		strings.NewReader(fmt.Sprintf("{\"username\":\"%s@pdxfixit.com\",\"password\":\"%s\"}", config.Vrops.User, pass)),
+		// not the session headers; by the next daemon run, their token will long since have expired
+		map[string]string{
+			"Accept":       "application/json",
+			"Content-Type": "application/json",
+		},
 	)
 	if err != nil {
-		log.Println(fmt.Sprintf("%s", session))
-		log.Fatal(err)
+		log.Infof("%s", session)
+		return "", err
 	}
 
 	// unmarshal the response into a struct
 	vropsSession := vropsSessionToken{}
 	if err := json.Unmarshal(session, &vropsSession); err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
-	if config.Collector.Debug {
-		log.Println(fmt.Sprintf("vRealizeOpsToken %s", vropsSession.Token))
-	}
+	registerSecret(vropsSession.Token)
+	log.Debugf("vRealizeOpsToken %s", vropsSession.Token)
 
-	return vropsSession.Token
+	return vropsSession.Token, nil
 
 }
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -23,7 +26,7 @@ func TestGetAdapterResources(t *testing.T) {
 
 	config.Vrops.Host = ts.URL
 
-	adapterResources, err := getAdapterResources("fake-id-because-its-a-test", 0)
+	adapterResources, err := getAdapterResources(context.Background(), "fake-id-because-its-a-test", 0)
 	if err != nil {
 		t.Errorf("%v", err)
 	}
@@ -68,6 +71,7 @@ func TestGetAdapterResources(t *testing.T) {
 func TestGetResourceProperties(t *testing.T) {
 
 	data := `{"resourceId":"2fb6adf9-7665-4bec-9d53-e49c5a71d63a","property":[{"name":"test","value":"yes"}]}`
+	payload := `{"resourceId":"2fb6adf9-7665-4bec-9d53-e49c5a71d63a","adapterInstanceId":"15a4759d-0b2f-4432-bbfd-9a6f4cfab7e4","property":[{"name":"test","value":"yes"}]}`
 
 	// setup fake http server for test
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -123,17 +127,30 @@ func TestGetResourceProperties(t *testing.T) {
 		},
 	}
 
-	collection := getResourceProperties(testResources)
+	collection := getResourceProperties(context.Background(), vropsAdapterInstance{ID: "15a4759d-0b2f-4432-bbfd-9a6f4cfab7e4", LastCollected: 1546909506780}, 2, testResources, nil, nil)
 
 	assert.Len(t, collection, 1, "count of records")
-	assert.Empty(t, collection[0].ID, "id should be empty")
+	assert.Equal(t, recordID("vrops-test-test_adapter_instance", "2fb6adf9-7665-4bec-9d53-e49c5a71d63a", nil), collection[0].ID, "id from the identifier")
 	assert.Equal(t, collection[0].Type, "vrops-test-test_adapter_instance", "record type")
 	assert.Empty(t, collection[0].Hostname, "hostname should be empty")
 	assert.Empty(t, collection[0].IP, "ip should be empty")
 	assert.NotEmpty(t, collection[0].Timestamp, "timestamp should not be empty")
 	assert.NotEmpty(t, collection[0].Committer, "committer should not be empty")
-	assert.Empty(t, collection[0].Context, "context should be empty")
-	assert.Equal(t, collection[0].Data, json.RawMessage(data), "payload")
+	collected, err := time.Parse(time.RFC3339, collection[0].Context["collected"].(string))
+	assert.NoError(t, err, "collected, in RFC 3339")
+	assert.WithinDuration(t, time.Now(), collected, time.Minute, "collected just now")
+	assert.Equal(t, collection[0].Context["collected"], collection[0].Timestamp, "timestamp, from when it was collected")
+	delete(collection[0].Context, "collected")
+
+	assert.Equal(t, map[string]interface{}{
+		"adapter_id":           "15a4759d-0b2f-4432-bbfd-9a6f4cfab7e4",
+		"page":                 2,
+		"resource_id":          "2fb6adf9-7665-4bec-9d53-e49c5a71d63a",
+		"resource_kind":        "Test Adapter Instance",
+		"vrops_host":           strings.TrimPrefix(ts.URL, "http://"),
+		"properties_collected": "2019-01-08T01:05:06Z",
+	}, collection[0].Context, "provenance")
+	assert.Equal(t, collection[0].Data, json.RawMessage(payload), "payload, with the identifier and adapter instance")
 	assert.Empty(t, collection[0].Hash, "hash should be empty")
 
 }
@@ -144,6 +161,7 @@ func TestGetResourceProperties(t *testing.T) {
 func TestVirtualMachineMetadata(t *testing.T) {
 
 	data := `{"resourceId":"01afa5ae-216f-4b27-91a7-43abfe5d5905","property":[{"name":"summary|guest|hostName","value":"localhost"},{"name":"summary|guest|ipAddress","value":"127.0.0.1"}]}`
+	payload := `{"resourceId":"01afa5ae-216f-4b27-91a7-43abfe5d5905","adapterInstanceId":"15a4759d-0b2f-4432-bbfd-9a6f4cfab7e4","property":[{"name":"summary|guest|hostName","value":"localhost"},{"name":"summary|guest|ipAddress","value":"127.0.0.1"}]}`
 
 	// setup fake http server for test
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -199,17 +217,30 @@ func TestVirtualMachineMetadata(t *testing.T) {
 		},
 	}
 
-	collection := getResourceProperties(testResources)
+	collection := getResourceProperties(context.Background(), vropsAdapterInstance{ID: "15a4759d-0b2f-4432-bbfd-9a6f4cfab7e4", LastCollected: 1546909506780}, 2, testResources, nil, nil)
 
 	assert.Len(t, collection, 1, "count of records")
-	assert.Empty(t, collection[0].ID, "id should be empty")
+	assert.Equal(t, recordID("vrops-vmware-virtualmachine", "01afa5ae-216f-4b27-91a7-43abfe5d5905", nil), collection[0].ID, "id from the identifier")
 	assert.Equal(t, collection[0].Type, "vrops-vmware-virtualmachine", "record type")
 	assert.Empty(t, collection[0].Hostname, "hostname should be empty")
 	assert.Empty(t, collection[0].IP, "ip should be empty")
 	assert.NotEmpty(t, collection[0].Timestamp, "timestamp should not be empty")
 	assert.NotEmpty(t, collection[0].Committer, "committer should not be empty")
-	assert.Empty(t, collection[0].Context, "context should be empty")
-	assert.Equal(t, collection[0].Data, json.RawMessage(data), "payload")
+	collected, err := time.Parse(time.RFC3339, collection[0].Context["collected"].(string))
+	assert.NoError(t, err, "collected, in RFC 3339")
+	assert.WithinDuration(t, time.Now(), collected, time.Minute, "collected just now")
+	assert.Equal(t, collection[0].Context["collected"], collection[0].Timestamp, "timestamp, from when it was collected")
+	delete(collection[0].Context, "collected")
+
+	assert.Equal(t, map[string]interface{}{
+		"adapter_id":           "15a4759d-0b2f-4432-bbfd-9a6f4cfab7e4",
+		"page":                 2,
+		"resource_id":          "01afa5ae-216f-4b27-91a7-43abfe5d5905",
+		"resource_kind":        "virtualmachine",
+		"vrops_host":           strings.TrimPrefix(ts.URL, "http://"),
+		"properties_collected": "2019-01-08T01:05:06Z",
+	}, collection[0].Context, "provenance")
+	assert.Equal(t, collection[0].Data, json.RawMessage(payload), "payload, with the identifier and adapter instance")
 	assert.Empty(t, collection[0].Hash, "hash should be empty")
 
 }
@@ -218,6 +249,7 @@ func TestGetSessionToken(t *testing.T) {
 
 	// setup fake http server for test
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Authorization"), "not the previous session's token")
 		_, err := fmt.Fprint(w, "{\"token\":\"c0e7aa16-43e1-45a9-abc6-b90c8155a3a7::8066a69b-f6f9-4d65-84b4-691a13f1346a\",\"validity\":1546127294284,\"expiresAt\":\"Tuesday, January 1, 2019 0:00:00 AM UTC\",\"roles\":[]}")
 		if err != nil {
 			t.Error(err.Error())
@@ -225,8 +257,88 @@ func TestGetSessionToken(t *testing.T) {
 	}))
 	defer ts.Close()
 
+	saved := config.Vrops.Host
+	defer func() { config.Vrops.Host = saved }()
 	config.Vrops.Host = ts.URL
 
-	assert.NotEmpty(t, getSessionToken())
+	// logged in before, e.g. on the daemon's previous run
+	vropsSessionHeaders["Authorization"] = "vRealizeOpsToken expired"
+	defer delete(vropsSessionHeaders, "Authorization")
+
+	token, err := getSessionToken(context.Background())
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token)
+
+}
+
+func TestLatestStatTime(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/suite-api/api/resources/2fb6adf9-7665-4bec-9d53-e49c5a71d63a/stats/latest", r.URL.Path, "path")
+		if _, err := fmt.Fprint(w, `{"values":[{"resourceId":"2fb6adf9-7665-4bec-9d53-e49c5a71d63a","stat-list":{"stat":[{"timestamps":[1546909506780],"statKey":{"key":"cpu|usage_average"},"data":[1.5]},{"timestamps":[1546909806780],"statKey":{"key":"mem|usage_average"},"data":[40.0]}]}}]}`); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	saved := config
+	defer func() { config = saved }()
+	config.Vrops.Host = ts.URL
+
+	latest, err := latestStatTime(context.Background(), "2fb6adf9-7665-4bec-9d53-e49c5a71d63a")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2019, 1, 8, 1, 10, 6, 780000000, time.UTC), latest, "the latest of the stats")
+
+}
+
+func TestGetResourcePropertiesTimestamps(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := `{"resourceId":"vm","property":[]}`
+		if strings.HasSuffix(r.URL.Path, "/stats/latest") {
+			response = `{"values":[{"resourceId":"vm","stat-list":{"stat":[{"timestamps":[1546909806780],"statKey":{"key":"cpu|usage_average"},"data":[1.5]}]}}]}`
+		}
+		if _, err := fmt.Fprint(w, response); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	saved := config
+	defer func() { config = saved }()
+
+	config.Vrops.Host = ts.URL
+	config.Vrops.ResourceKindKeys = []string{"VirtualMachine"}
+	config.Collector.Timestamp = timestampVrops
+
+	adapter := vropsAdapterInstance{ID: "adapter-a", LastCollected: 1546909506780}
+	resources := []vropsResource{{ResourceKey: vropsResourceKey{AdapterKindKey: "VMWARE", ResourceKindKey: "VirtualMachine"}, Identifier: "vm"}}
+
+	// from the adapter's last collection
+	config.Vrops.StatTimestamps = false
+	collection := getResourceProperties(context.Background(), adapter, 0, resources, nil, nil)
+	if assert.Len(t, collection, 1) {
+		assert.Equal(t, "2019-01-08T01:05:06Z", collection[0].Timestamp, "last collected")
+		assert.Equal(t, "2019-01-08T01:05:06Z", collection[0].Context["properties_collected"], "properties collected")
+		assert.NotContains(t, collection[0].Context, "vrops_timestamp", "no stats asked for")
+		assert.NotEmpty(t, collection[0].Context["collected"], "collected")
+	}
+
+	// from the resource's latest stats
+	config.Vrops.StatTimestamps = true
+	collection = getResourceProperties(context.Background(), adapter, 0, resources, nil, nil)
+	if assert.Len(t, collection, 1) {
+		assert.Equal(t, "2019-01-08T01:10:06Z", collection[0].Timestamp, "latest stats")
+		assert.Equal(t, "2019-01-08T01:10:06Z", collection[0].Context["vrops_timestamp"], "latest stats")
+		assert.Equal(t, "2019-01-08T01:05:06Z", collection[0].Context["properties_collected"], "properties collected")
+	}
+
+	// vROps doesn't know, so when it was collected
+	config.Vrops.StatTimestamps = false
+	collection = getResourceProperties(context.Background(), vropsAdapterInstance{ID: "adapter-a"}, 0, []vropsResource{{ResourceKey: vropsResourceKey{AdapterKindKey: "VMWARE", ResourceKindKey: "VirtualMachine"}, Identifier: "unknown"}}, nil, nil)
+	if assert.Len(t, collection, 1) {
+		assert.Equal(t, collection[0].Context["collected"], collection[0].Timestamp, "collected")
+		assert.NotContains(t, collection[0].Context, "properties_collected", "no vrops timestamp")
+	}
 
 }